@@ -0,0 +1,307 @@
+package itamaelocal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+func (p *Provisioner) unpackSourceArchive(path, checksum string) (string, error) {
+	if checksum != "" {
+		if err := verifyChecksum(path, checksum); err != nil {
+			return "", fmt.Errorf("source_archive: %s", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "packer-itamae-archive")
+	if err != nil {
+		return "", fmt.Errorf("source_archive: unable to create temporary directory: %s", err)
+	}
+	p.tempDirs = append(p.tempDirs, dir)
+
+	if err := extractArchive(path, dir); err != nil {
+		return "", fmt.Errorf("source_archive: unable to unpack %s: %s", path, err)
+	}
+	return dir, nil
+}
+
+//
+func extractArchive(path, dst string) (err error) {
+	name := strings.ToLower(path)
+
+	if strings.HasSuffix(name, ".zip") {
+		return extractZip(path, dst)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		return extractTar(gr, dst)
+	case strings.HasSuffix(name, ".tar"):
+		return extractTar(f, dst)
+	}
+	return fmt.Errorf("unsupported archive format, must be one of: .tar, .tar.gz, .tgz or .zip")
+}
+
+//
+func extractZip(path, dst string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		path, err := archivePath(dst, zf.Name)
+		if err != nil {
+			return err
+		}
+
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+
+		err = writeArchiveFile(path, r, zf.Mode())
+		if cerr := r.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+func verifyChecksum(path, checksum string) (err error) {
+	kind, expected := "sha256", checksum
+	if idx := strings.Index(checksum, ":"); idx > -1 {
+		kind, expected = strings.ToLower(checksum[:idx]), checksum[idx+1:]
+	}
+
+	var h hash.Hash
+	switch kind {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported checksum type: %s", kind)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, strings.TrimSpace(expected)) {
+		return fmt.Errorf("%s checksum mismatch for %s, given %s, want %s", kind, path, actual, expected)
+	}
+	return nil
+}
+
+//
+func extractTar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return verifyArchiveSymlinks(dst)
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := archivePath(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeArchiveFile(path, tr, hdr.FileInfo().Mode()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := writeArchiveSymlink(dst, path, hdr.Linkname); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//
+func archivePath(dst, name string) (string, error) {
+	path := filepath.Join(dst, filepath.FromSlash(name))
+	if !withinDir(dst, path) {
+		return "", fmt.Errorf("archive entry %s is outside of the destination directory", name)
+	}
+
+	root, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return "", err
+	}
+
+	//
+	parent, err := resolveExistingPath(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+
+	if !withinDir(root, parent) {
+		return "", fmt.Errorf("archive entry %s resolves outside of the destination directory", name)
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("archive entry %s would be written through a symlink", name)
+	}
+	return path, nil
+}
+
+//
+func resolveExistingPath(path string) (string, error) {
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return resolved, nil
+		}
+
+		if !os.IsNotExist(err) || filepath.Dir(path) == path {
+			return "", err
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+//
+func verifyArchiveSymlinks(dst string) error {
+	root, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		//
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil && !withinDir(root, resolved) {
+			return fmt.Errorf("archive entry %s links outside of the destination directory", path)
+		}
+		return nil
+	})
+}
+
+//
+func withinDir(dir, path string) bool {
+	dir, path = filepath.Clean(dir), filepath.Clean(path)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+//
+func writeArchiveFile(path string, r io.Reader, mode os.FileMode) (err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+//
+func writeArchiveSymlink(dst, path, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("archive entry %s links to an absolute path %s", path, target)
+	}
+
+	if !withinDir(dst, filepath.Join(filepath.Dir(path), target)) {
+		return fmt.Errorf("archive entry %s links outside of the destination directory", path)
+	}
+
+	//
+	dir := filepath.Dir(path)
+	for _, part := range strings.Split(filepath.ToSlash(target), "/") {
+		dir = filepath.Join(dir, part)
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %s links through another symlink %s", path, dir)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
@@ -0,0 +1,337 @@
+package itamaelocal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testArchive(t *testing.T, name string, files map[string]string) string {
+	directory, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+
+	path := filepath.Join(directory, name)
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer f.Close()
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if strings.HasSuffix(name, ".zip") {
+		zw := zip.NewWriter(f)
+		for _, name := range names {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatalf("unable to create archive entry: %s", err)
+			}
+			io.WriteString(w, files[name])
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("unable to create archive: %s", err)
+		}
+		return path
+	}
+
+	var w io.Writer = f
+	if strings.HasSuffix(name, "gz") {
+		gw := gzip.NewWriter(f)
+		defer gw.Close()
+		w = gw
+	}
+
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("unable to create archive entry: %s", err)
+		}
+		io.WriteString(tw, files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unable to create archive: %s", err)
+	}
+	return path
+}
+
+func TestProvisionerPrepare_SourceArchive(t *testing.T) {
+	files := map[string]string{
+		"default.rb":       "package 'nginx'",
+		"nginx/ssl.rb":     "",
+		"nginx/vhost.rb":   "",
+		"nginx/README.txt": "",
+	}
+
+	for _, name := range []string{"recipes.tar", "recipes.tar.gz", "recipes.tgz", "recipes.zip"} {
+		var p Provisioner
+
+		config := testConfig()
+
+		archive := testArchive(t, name, files)
+		defer os.RemoveAll(filepath.Dir(archive))
+
+		config["source_archive"] = archive
+		config["recipes"] = []string{
+			"default.rb",
+			"nginx",
+		}
+
+		err := p.Prepare(config)
+		if err != nil {
+			t.Errorf("should not error for %s, but got: %s", name, err)
+			continue
+		}
+
+		expected := []string{
+			"default.rb",
+			"nginx/ssl.rb",
+			"nginx/vhost.rb",
+		}
+
+		if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+			t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(p.config.SourceDir, "default.rb"))
+		if err != nil || string(content) != files["default.rb"] {
+			t.Errorf("incorrect content for %s, given \"%s\", want \"%s\"",
+				name, content, files["default.rb"])
+		}
+		p.removeTempDirs()
+	}
+}
+
+func TestProvisionerPrepare_SourceArchiveChecksum(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	archive := testArchive(t, "recipes.tar.gz", map[string]string{
+		"default.rb": "",
+	})
+	defer os.RemoveAll(filepath.Dir(archive))
+
+	content, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("unable to read temporary file: %s", err)
+	}
+
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	config["source_archive"] = archive
+	config["recipes"] = []string{
+		"default.rb",
+	}
+
+	for _, value := range []string{checksum, "sha256:" + strings.ToUpper(checksum)} {
+		p = Provisioner{}
+
+		config["source_archive_checksum"] = value
+		err = p.Prepare(config)
+		if err != nil {
+			t.Errorf("should not error, but got: %s", err)
+		}
+		p.removeTempDirs()
+	}
+
+	for _, value := range []string{"sha256:0123456789abcdef", "crc32:" + checksum} {
+		p = Provisioner{}
+
+		config["source_archive_checksum"] = value
+		err = p.Prepare(config)
+		if err == nil {
+			t.Errorf("should be an error if source_archive_checksum is %s", value)
+		}
+
+		if len(p.tempDirs) != 0 {
+			t.Errorf("should remove temporary directories, but got: %v", p.tempDirs)
+		}
+	}
+
+	p = Provisioner{}
+	delete(config, "source_archive")
+
+	config["source_archive_checksum"] = checksum
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if source_archive_checksum is set without source_archive")
+	}
+}
+
+func TestProvisionerPrepare_SourceArchiveInvalid(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	archive := testArchive(t, "recipes.tar", map[string]string{
+		"../escape.rb": "",
+	})
+	defer os.RemoveAll(filepath.Dir(archive))
+
+	config["source_archive"] = archive
+	config["recipes"] = []string{
+		"default.rb",
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if archive contains entries outside of the destination")
+	}
+
+	p = Provisioner{}
+
+	config["source_archive"] = strings.TrimSuffix(archive, ".tar") + ".rar"
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if archive format is not supported")
+	}
+
+	p = Provisioner{}
+
+	config["source_archive"] = archive
+	config["source_directory"] = os.TempDir()
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if both source_directory and source_archive are set")
+	}
+}
+
+func TestProvisionerProvision_SourceArchive(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	ui := testUI(nil)
+	comm := testCommunicator()
+	config := testConfig()
+
+	archive := testArchive(t, "recipes.zip", map[string]string{
+		"default.rb": "",
+	})
+	defer os.RemoveAll(filepath.Dir(archive))
+
+	config["source_archive"] = archive
+	config["recipes"] = []string{
+		"default.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	prepared := p.config.SourceDir
+
+	failing := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return "", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, failing)
+	if err == nil {
+		t.Fatalf("should be an error if Itamae fails")
+	}
+
+	source := strings.TrimSuffix(failing.UploadDirSrc, "/")
+	if source != prepared {
+		t.Errorf("should use source unpacked by Prepare, given: \"%v\", want \"%v\"", source, prepared)
+	}
+
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("should remove unpacked source directory %s after a failure", source)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	retry := strings.TrimSuffix(comm.UploadDirSrc, "/")
+	if retry == "" || retry == source {
+		t.Errorf("should unpack source archive again for a retry, but got: %s", retry)
+	}
+
+	if _, err := os.Stat(retry); !os.IsNotExist(err) {
+		t.Errorf("should remove unpacked source directory %s", retry)
+	}
+}
+
+func TestExtractTar_Symlinks(t *testing.T) {
+	type entry struct {
+		name, link string
+	}
+
+	testCases := [][]entry{
+		{{"l", "."}, {"l2", "l/.."}, {"l2/pwned", ""}},
+		{{"a", "x/.."}, {"x", "."}},
+		{{"a", "x"}, {"a/pwned", ""}},
+	}
+
+	for _, entries := range testCases {
+		parent, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatalf("unable to create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(parent)
+
+		dst := filepath.Join(parent, "dst")
+		if err := os.Mkdir(dst, 0755); err != nil {
+			t.Fatalf("unable to create directory: %s", err)
+		}
+
+		var buffer bytes.Buffer
+
+		tw := tar.NewWriter(&buffer)
+		for _, e := range entries {
+			hdr := &tar.Header{
+				Name:     e.name,
+				Mode:     0644,
+				Typeflag: tar.TypeReg,
+			}
+			if e.link != "" {
+				hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("unable to create archive entry: %s", err)
+			}
+		}
+		tw.Close()
+
+		err = extractTar(&buffer, dst)
+		if err == nil {
+			t.Errorf("should be an error if archive entries %v escape the destination", entries)
+		}
+
+		if _, err := os.Lstat(filepath.Join(parent, "pwned")); err == nil {
+			t.Errorf("should not write outside of the destination for %v", entries)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package itamaelocal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	DefaultCheckpointName = ".packer-itamae-checkpoint"
+)
+
+//
+type checkpoint struct {
+	recipes   []string
+	checksums map[string]string
+}
+
+//
+func (p *Provisioner) checkpointPath() string {
+	return path.Join(p.config.StagingDir, DefaultCheckpointName)
+}
+
+//
+func (p *Provisioner) loadCheckpoint(ui packer.Ui, comm packer.Communicator) *checkpoint {
+	c := &checkpoint{
+		checksums: make(map[string]string),
+	}
+
+	if !p.config.Resume {
+		return c
+	}
+
+	stdout, status, err := runRemoteCommand(comm, fmt.Sprintf("cat '%s' 2>/dev/null", p.checkpointPath()))
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to read checkpoint, executing all recipes: %s", err))
+		return c
+	}
+
+	if status != 0 {
+		return c
+	}
+
+	checksums, err := readChecksums(strings.NewReader(stdout))
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to parse checkpoint, executing all recipes: %s", err))
+		return c
+	}
+	c.recipes = sortedKeys(checksums)
+	c.checksums = checksums
+	return c
+}
+
+//
+func (c *checkpoint) completed(name, sum string) bool {
+	return sum != "" && c.checksums[name] == sum
+}
+
+//
+func (c *checkpoint) add(name, sum string) {
+	if _, ok := c.checksums[name]; !ok {
+		c.recipes = append(c.recipes, name)
+	}
+	c.checksums[name] = sum
+}
+
+//
+func (c *checkpoint) String() string {
+	lines := make([]string, 0, len(c.recipes))
+	for _, name := range c.recipes {
+		lines = append(lines, fmt.Sprintf("%s  %s\n", c.checksums[name], name))
+	}
+	return strings.Join(lines, "")
+}
+
+//
+func (p *Provisioner) saveCheckpoint(comm packer.Communicator, c *checkpoint) error {
+	return comm.Upload(p.checkpointPath(), strings.NewReader(c.String()), nil)
+}
+
+//
+func (p *Provisioner) recipeChecksum(recipe string) string {
+	for _, remote := range p.config.RemoteRecipes {
+		if recipe == remote {
+			return ""
+		}
+	}
+
+	var sum string
+	if recipe == DefaultInlineRecipeName && p.config.inlineRecipe != nil {
+		s := sha256.Sum256([]byte(strings.Join(p.config.inlineRecipe, "\n") + "\n"))
+		sum = hex.EncodeToString(s[:])
+	} else {
+		s, err := checksumFile(p.prefixPath(recipe, p.config.SourceDir))
+		if err != nil {
+			return ""
+		}
+		sum = s
+	}
+
+	//
+	lines := []string{"recipe " + sum}
+
+	files := map[string]string{
+		"node_json": p.config.NodeJSON,
+		"node_yaml": p.config.NodeYAML,
+	}
+
+	for _, name := range sortedKeys(files) {
+		if files[name] == "" {
+			continue
+		}
+
+		s, err := checksumFile(p.prefixPath(files[name], p.config.SourceDir))
+		if err != nil {
+			return ""
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", name, s))
+	}
+
+	for _, kv := range p.config.Vars {
+		lines = append(lines, "environment_vars "+kv)
+	}
+
+	s := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(s[:])
+}
+
+//
+func (p *Provisioner) checkpointName(recipe string) string {
+	name := filepath.ToSlash(filepath.Clean(filepath.FromSlash(recipe)))
+	if p.phase != "" {
+		name = p.phase + ":" + name
+	}
+	return name
+}
@@ -0,0 +1,205 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_Resume(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["resume"] = true
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if resume is set without isolate_recipes")
+	}
+
+	p = Provisioner{}
+
+	config["isolate_recipes"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+}
+
+func TestProvisionerProvision_Resume(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb": `package "curl"`,
+		"app.rb":  `package "nginx"`,
+		"web.rb":  `service "nginx"`,
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{"base.rb", "app.rb", "web.rb"}
+	config["isolate_recipes"] = true
+	config["resume"] = true
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.HasPrefix(command, "cat '"+p.checkpointPath()+"'") {
+			return "", 1
+		}
+		if strings.Contains(command, "itamae local") && strings.HasSuffix(command, "app.rb") {
+			return "", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Fatalf("should be an error if a recipe fails")
+	}
+
+	if comm.UploadPath != p.checkpointPath() {
+		t.Fatalf("incorrect checkpoint path, given %s, want %s", comm.UploadPath, p.checkpointPath())
+	}
+
+	if expected := p.recipeChecksum("base.rb") + "  base.rb\n"; comm.UploadData != expected {
+		t.Errorf("incorrect checkpoint, given %q, want %q", comm.UploadData, expected)
+	}
+
+	saved := comm.UploadData
+
+	testResume := func() []string {
+		comm := testCommandCommunicator(func(command string) (string, int) {
+			if strings.HasPrefix(command, "cat '"+p.checkpointPath()+"'") {
+				return saved, 0
+			}
+			return "", 0
+		})
+
+		err = p.Provision(ui, comm)
+		if err != nil {
+			t.Errorf("should not error, but got: %s", err)
+		}
+
+		if comm.UploadData != "" {
+			saved = comm.UploadData
+		}
+		return testItamaeCommands(comm.Commands)
+	}
+
+	testSaved := func() {
+		for _, name := range []string{"app.rb", "base.rb", "web.rb"} {
+			if ok := strings.Contains(saved, p.recipeChecksum(name)+"  "+name+"\n"); !ok {
+				t.Errorf("should keep %s in checkpoint, but got: %q", name, saved)
+			}
+		}
+	}
+
+	commands := testResume()
+	if len(commands) != 2 {
+		t.Fatalf("incorrect number of runs, given %d, want %d", len(commands), 2)
+	}
+
+	if ok := strings.HasSuffix(commands[0], "app.rb"); !ok {
+		t.Errorf("should resume from the failed recipe, but got: %s", commands[0])
+	}
+
+	expected := "Skipping recipe 1 of 3: base.rb%!(PACKER_COMMA) completed in a previous attempt"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include skipped recipe, but got: %s", buffer)
+	}
+
+	testSaved()
+
+	err = ioutil.WriteFile(filepath.Join(directory, "base.rb"), []byte(`package "wget"`), 0644)
+	if err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+
+	if commands := testResume(); len(commands) != 1 {
+		t.Errorf("should execute changed recipes again, but got %d runs", len(commands))
+	}
+
+	testSaved()
+}
+
+func TestProvisionerProvision_ResumePhases(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb": `package "curl"`,
+		"app.rb":  `package "nginx"`,
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["isolate_recipes"] = true
+	config["resume"] = true
+	config["phases"] = []map[string]interface{}{
+		{
+			"name":    "base",
+			"recipes": []string{"base.rb"},
+		},
+		{
+			"name":             "app",
+			"recipes":          []string{"base.rb", "app.rb"},
+			"environment_vars": []string{"ROLE=app"},
+		},
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	var comm *recordingCommunicator
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		if strings.HasPrefix(command, "cat '"+p.checkpointPath()+"'") {
+			return comm.UploadData, 0
+		}
+		return "", 0
+	})
+
+	err = p.Provision(testUI(nil), comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	commands := testItamaeCommands(comm.Commands)
+	if len(commands) != 3 {
+		t.Fatalf("should execute recipes shared by phases in each phase, but got %d runs", len(commands))
+	}
+
+	expected := []string{"base:base.rb", "app:base.rb", "app:app.rb"}
+	for _, name := range expected {
+		if ok := strings.Contains(comm.UploadData, "  "+name+"\n"); !ok {
+			t.Errorf("should key checkpoint by phase, but got: %q", comm.UploadData)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package itamaelocal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	//
+	DefaultGPGCommand = "gpg"
+)
+
+//
+func (p *Provisioner) verifySourceChecksums() error {
+	if len(p.config.TrustedKeys) > 0 {
+		if err := verifySignature(p.config.SourceChecksums, p.config.SourceChecksumsSignature, p.config.TrustedKeys); err != nil {
+			return fmt.Errorf("source_checksums: %s", err)
+		}
+	}
+
+	expected, err := parseChecksums(p.config.SourceChecksums)
+	if err != nil {
+		return fmt.Errorf("source_checksums: %s is invalid: %s", p.config.SourceChecksums, err)
+	}
+
+	roots := append([]string{p.config.SourceDir}, p.config.SourceDirs...)
+
+	exclude := make(map[string]bool)
+	for _, path := range []string{p.config.SourceChecksums, p.config.SourceChecksumsSignature} {
+		if path == "" {
+			continue
+		}
+
+		for _, root := range roots {
+			if rel, ok := relativePath(root, path); ok {
+				exclude[rel] = true
+			}
+		}
+	}
+
+	actual, err := checksumFiles(p.config.SourceDir, exclude)
+	if err != nil {
+		return fmt.Errorf("source_checksums: unable to compute checksums: %s", err)
+	}
+
+	var problems []string
+
+	for _, name := range sortedKeys(actual) {
+		sum, ok := expected[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unexpected file: %s", name))
+		} else if !strings.EqualFold(sum, actual[name]) {
+			problems = append(problems, fmt.Sprintf("modified file: %s", name))
+		}
+	}
+
+	for _, name := range sortedKeys(expected) {
+		if _, ok := actual[name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing file: %s", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("source_checksums: %s does not match %s:\n%s",
+			p.config.SourceChecksums, p.config.SourceDir, strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+//
+func (p *Provisioner) validateChecksumsConfig() error {
+	if p.config.SourceDir == "" {
+		return fmt.Errorf("source_checksums: requires a source directory to be specified")
+	}
+
+	paths := map[string]string{
+		"source_checksums": p.config.SourceChecksums,
+	}
+
+	if len(p.config.TrustedKeys) > 0 {
+		if p.config.SourceChecksumsSignature == "" {
+			return fmt.Errorf("source_checksums_signature: must be specified when trusted_keys are set")
+		}
+		paths["source_checksums_signature"] = p.config.SourceChecksumsSignature
+
+		for idx, key := range p.config.TrustedKeys {
+			paths[fmt.Sprintf("trusted_keys[%d]", idx)] = key
+		}
+	} else if p.config.SourceChecksumsSignature != "" {
+		return fmt.Errorf("trusted_keys: must be specified when source_checksums_signature is set")
+	}
+
+	for _, config := range sortedKeys(paths) {
+		fi, err := os.Stat(paths[config])
+		if err != nil {
+			return fmt.Errorf("%s: %s is invalid: %s", config, paths[config], err)
+		}
+
+		if fi.IsDir() {
+			return fmt.Errorf("%s: %s must point to a file", config, paths[config])
+		}
+	}
+	return nil
+}
+
+//
+func parseChecksums(path string) (checksums map[string]string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	return readChecksums(f)
+}
+
+//
+func readChecksums(r io.Reader) (map[string]string, error) {
+	checksums := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("line %d is not in format '<sha256>  <path>'", line)
+		}
+
+		if _, err := hex.DecodeString(fields[0]); err != nil {
+			return nil, fmt.Errorf("line %d contains an invalid checksum: %s", line, err)
+		}
+
+		name := strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		name = filepath.ToSlash(filepath.Clean(filepath.FromSlash(name)))
+		checksums[name] = fields[0]
+	}
+	return checksums, scanner.Err()
+}
+
+//
+func checksumFiles(root string, exclude map[string]bool) (map[string]string, error) {
+	checksums := make(map[string]string)
+
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		//
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("symlink %s is invalid: %s", filepath.ToSlash(rel), err)
+			}
+
+			if !target.Mode().IsRegular() {
+				return fmt.Errorf("symlink %s must point to a file", filepath.ToSlash(rel))
+			}
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		if exclude[filepath.ToSlash(rel)] {
+			return nil
+		}
+
+		sum, err := checksumFile(path)
+		if err != nil {
+			return err
+		}
+		checksums[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	return checksums, err
+}
+
+//
+func checksumFile(path string) (sum string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//
+func verifySignature(path, signature string, keys []string) error {
+	home, err := ioutil.TempDir("", "packer-itamae-gnupg")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(home)
+
+	args := append([]string{"--import"}, keys...)
+	if _, err := runGPG(home, args...); err != nil {
+		return fmt.Errorf("unable to import trusted keys: %s", err)
+	}
+
+	output, err := runGPG(home, "--status-fd", "1", "--verify", signature, path)
+	if err != nil {
+		return fmt.Errorf("unable to verify signature %s: %s", signature, err)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "[GNUPG:] VALIDSIG ") {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature %s was not made by any of the trusted keys", signature)
+}
+
+//
+func runGPG(home string, args ...string) (string, error) {
+	args = append([]string{"--batch", "--no-tty", "--homedir", home}, args...)
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(DefaultGPGCommand, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%s: %s", err, message)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+//
+func relativePath(root, path string) (string, bool) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", false
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil || !withinDir(root, path) {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+//
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
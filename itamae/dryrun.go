@@ -0,0 +1,43 @@
+package itamaelocal
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+//
+func (p *Provisioner) dryRunItamae(ui packer.Ui, comm packer.Communicator) error {
+	ui.Message("Executing Itamae dry run...")
+
+	run, err := p.runItamae(ui, comm, true)
+	if err != nil {
+		return err
+	}
+
+	if err := p.validateExitStatus(run.status, p.config.ValidExitCodes); err != nil {
+		if p.config.inlineRecipe != nil {
+			for _, message := range p.inlineRecipeErrors(run.output) {
+				ui.Error(message)
+			}
+		}
+		return err
+	}
+
+	p.reportPlannedChanges(ui, run.output)
+	return nil
+}
+
+//
+func (p *Provisioner) reportPlannedChanges(ui packer.Ui, output string) {
+	resources := changedResources(output)
+	if len(resources) == 0 {
+		ui.Message("Dry run completed, no changes planned.")
+		return
+	}
+
+	ui.Message(fmt.Sprintf("Dry run completed, %d resource(s) will change:", len(resources)))
+	for _, resource := range resources {
+		ui.Message(fmt.Sprintf("Planned change: %s", resource))
+	}
+}
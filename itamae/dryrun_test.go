@@ -0,0 +1,155 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testItamaeCommands(commands []string) []string {
+	itamae := make([]string, 0)
+	for _, command := range commands {
+		if strings.Contains(command, "itamae local") {
+			itamae = append(itamae, command)
+		}
+	}
+	return itamae
+}
+
+func TestProvisionerProvision_DryRunFirst(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["dry_run_first"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	status := 2
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "--dry-run") {
+			return " INFO :   package[nginx] installed will change from 'false' to 'true'\n", status
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	commands := testItamaeCommands(comm.Commands)
+	if len(commands) != 2 {
+		t.Fatalf("incorrect number of runs, given %d, want %d", len(commands), 2)
+	}
+
+	if !strings.Contains(commands[0], "--dry-run") || strings.Contains(commands[1], "--dry-run") {
+		t.Errorf("should execute dry run first, but got: %v", commands)
+	}
+
+	expected := "Planned change: package[nginx]"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include planned changes, but got: %s", buffer)
+	}
+
+	status = 1
+	comm.Commands = nil
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if dry run fails")
+	}
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 1 {
+		t.Errorf("should not execute Itamae after a failed dry run, but got: %v", commands)
+	}
+}
+
+func TestProvisionerProvision_DryRunOnly(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["dry_run_only"] = true
+	config["dry_run_first"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return "", 2
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	commands := testItamaeCommands(comm.Commands)
+	if len(commands) != 1 || !strings.Contains(commands[0], "--dry-run") {
+		t.Errorf("should only execute a dry run, but got: %v", commands)
+	}
+
+	expected := "no changes will be applied"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include dry run notice, but got: %s", buffer)
+	}
+
+	p = Provisioner{}
+
+	config["fail_on_change"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if dry run reports changes and fail_on_change is set")
+	}
+
+	p = Provisioner{}
+	delete(config, "fail_on_change")
+
+	config["verify_idempotency"] = true
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if both dry_run_only and verify_idempotency are set")
+	}
+}
@@ -0,0 +1,293 @@
+package itamaelocal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	DefaultEventsFileName = "packer-itamae-events.json"
+
+	//
+	DefaultEventsConfigName = "packer-itamae-config.yml"
+)
+
+var (
+	//
+	handlersRegexp = regexp.MustCompile(`(?m)^handlers\s*:`)
+)
+
+//
+type itamaeEvent struct {
+	Time    time.Time
+	Event   string
+	Payload map[string]interface{}
+}
+
+//
+type resourceResult struct {
+	recipe   string
+	name     string
+	status   string
+	start    time.Time
+	duration time.Duration
+}
+
+//
+type recipeResult struct {
+	path      string
+	failed    bool
+	start     time.Time
+	duration  time.Duration
+	updated   int
+	skipped   int
+	errors    int
+	resources []*resourceResult
+}
+
+//
+func (p *Provisioner) collectsEvents() bool {
+	return p.config.ReportEvents || p.config.ReportJUnit != ""
+}
+
+//
+func (p *Provisioner) eventsPath() string {
+	return filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultEventsFileName))
+}
+
+//
+func (p *Provisioner) eventsConfigPath() string {
+	return filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultEventsConfigName))
+}
+
+//
+func (p *Provisioner) prepareEventsConfig() error {
+	path := p.prefixPath(p.config.ConfigFile, p.config.SourceDir)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config_file: %s is invalid: %s", path, err)
+	}
+
+	if handlersRegexp.Match(content) {
+		return fmt.Errorf("config_file: %s already defines handlers, "+
+			"which cannot be combined with report_events", path)
+	}
+
+	p.config.eventsConfig = string(content)
+	return nil
+}
+
+//
+func (p *Provisioner) uploadEventsConfig(ui packer.Ui, comm packer.Communicator) error {
+	content := p.config.eventsConfig
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	content += fmt.Sprintf("handlers:\n"+
+		"  - type: json\n"+
+		"    path: '%s'\n", p.eventsPath())
+
+	ui.Message(fmt.Sprintf("Uploading Itamae configuration: %s", DefaultEventsConfigName))
+	p.machine(ui, "upload", "file", DefaultEventsConfigName, p.eventsConfigPath())
+	return comm.Upload(p.eventsConfigPath(), strings.NewReader(content), nil)
+}
+
+//
+func (p *Provisioner) collectEvents(ui packer.Ui, comm packer.Communicator) []itamaeEvent {
+	var buffer bytes.Buffer
+
+	path := p.eventsPath()
+	if err := comm.Download(path, &buffer); err != nil {
+		log.Printf("Unable to download Itamae events from %s: %s", path, err)
+		ui.Error(fmt.Sprintf("Unable to download Itamae events: %s", err))
+		return nil
+	}
+
+	cmd := &packer.RemoteCmd{
+		Command: p.guestCommands.RemoveDir(path),
+	}
+	if err := cmd.StartWithUi(comm, ui); err != nil || cmd.ExitStatus != 0 {
+		log.Printf("Unable to remove Itamae events from %s", path)
+	}
+
+	events, err := parseEvents(buffer.Bytes())
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to parse Itamae events: %s", err))
+	}
+	return events
+}
+
+//
+func (p *Provisioner) reportEvents(ui packer.Ui, events []itamaeEvent) {
+	if len(events) == 0 {
+		ui.Message("No Itamae events were recorded.")
+		return
+	}
+
+	recipes := summarizeEvents(events)
+
+	var updated, skipped, errors int
+	for _, recipe := range recipes {
+		updated += recipe.updated
+		skipped += recipe.skipped
+		errors += recipe.errors
+	}
+
+	ui.Message(fmt.Sprintf("Itamae resources: %d updated, %d skipped, %d failed",
+		updated, skipped, errors))
+
+	for _, recipe := range recipes {
+		ui.Message(fmt.Sprintf("Recipe %s: %s (%d updated, %d skipped, %d failed)",
+			recipe.path, recipe.duration, recipe.updated, recipe.skipped, recipe.errors))
+	}
+
+	for _, recipe := range recipes {
+		for _, resource := range recipe.resources {
+			if resource.status == "failed" {
+				ui.Error(fmt.Sprintf("Failed resource: %s in %s", resource.name, recipe.path))
+			}
+		}
+	}
+}
+
+//
+func parseEvents(data []byte) ([]itamaeEvent, error) {
+	events := make([]itamaeEvent, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var raw struct {
+			Time    interface{}            `json:"time"`
+			Event   string                 `json:"event"`
+			Payload map[string]interface{} `json:"payload"`
+		}
+
+		if err := json.Unmarshal([]byte(text), &raw); err != nil {
+			return events, fmt.Errorf("line %d is invalid: %s", line, err)
+		}
+
+		event := itamaeEvent{
+			Event:   raw.Event,
+			Payload: raw.Payload,
+		}
+
+		switch t := raw.Time.(type) {
+		case float64:
+			sec := int64(t)
+			event.Time = time.Unix(sec, int64((t-float64(sec))*float64(time.Second)))
+		case string:
+			if parsed, err := time.Parse(time.RFC3339Nano, t); err == nil {
+				event.Time = parsed
+			}
+		}
+
+		if event.Payload == nil {
+			event.Payload = make(map[string]interface{})
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+//
+func summarizeEvents(events []itamaeEvent) []*recipeResult {
+	var stack []*recipeResult
+	var resource *resourceResult
+	var changed bool
+
+	recipes := make([]*recipeResult, 0)
+
+	for _, event := range events {
+		var current *recipeResult
+		if len(stack) > 0 {
+			current = stack[len(stack)-1]
+		}
+
+		switch event.Event {
+		case "recipe_started":
+			recipe := &recipeResult{
+				path:  payloadString(event.Payload, "path"),
+				start: event.Time,
+			}
+			recipes = append(recipes, recipe)
+			stack = append(stack, recipe)
+		case "recipe_completed", "recipe_failed":
+			if current == nil {
+				continue
+			}
+			current.duration = event.Time.Sub(current.start)
+			current.failed = event.Event == "recipe_failed"
+			stack = stack[:len(stack)-1]
+		case "resource_started":
+			resource = &resourceResult{
+				name: fmt.Sprintf("%s[%s]",
+					payloadString(event.Payload, "resource_type"),
+					payloadString(event.Payload, "resource_name")),
+				start: event.Time,
+			}
+			if current != nil {
+				resource.recipe = current.path
+			}
+			changed = false
+		case "attribute_changed":
+			changed = true
+		case "resource_completed", "resource_failed":
+			if resource == nil || current == nil {
+				continue
+			}
+			resource.duration = event.Time.Sub(resource.start)
+
+			switch {
+			case event.Event == "resource_failed":
+				resource.status = "failed"
+				current.errors++
+			case changed:
+				resource.status = "updated"
+				current.updated++
+			default:
+				resource.status = "skipped"
+				current.skipped++
+			}
+
+			current.resources = append(current.resources, resource)
+			resource = nil
+		}
+	}
+
+	if len(events) > 0 {
+		last := events[len(events)-1].Time
+		for _, recipe := range stack {
+			recipe.duration = last.Sub(recipe.start)
+			recipe.failed = true
+		}
+	}
+	return recipes
+}
+
+//
+func payloadString(payload map[string]interface{}, key string) string {
+	if value, ok := payload[key]; ok && value != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return ""
+}
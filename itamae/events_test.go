@@ -0,0 +1,161 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testEvents = `{"time":"2017-11-01T10:00:00Z","event":"recipe_started","payload":{"path":"/tmp/packer-itamae/default.rb"}}
+{"time":"2017-11-01T10:00:01Z","event":"resource_started","payload":{"resource_type":"package","resource_name":"nginx"}}
+{"time":"2017-11-01T10:00:02Z","event":"attribute_changed","payload":{"attr":"installed","from":false,"to":true}}
+{"time":"2017-11-01T10:00:03Z","event":"resource_completed","payload":{"resource_type":"package","resource_name":"nginx"}}
+{"time":"2017-11-01T10:00:03Z","event":"recipe_started","payload":{"path":"/tmp/packer-itamae/nested.rb"}}
+{"time":"2017-11-01T10:00:03Z","event":"resource_started","payload":{"resource_type":"service","resource_name":"nginx"}}
+{"time":"2017-11-01T10:00:04Z","event":"resource_completed","payload":{"resource_type":"service","resource_name":"nginx"}}
+{"time":"2017-11-01T10:00:04Z","event":"recipe_completed","payload":{"path":"/tmp/packer-itamae/nested.rb"}}
+{"time":"2017-11-01T10:00:04Z","event":"resource_started","payload":{"resource_type":"file","resource_name":"/etc/motd"}}
+{"time":"2017-11-01T10:00:05Z","event":"resource_failed","payload":{"resource_type":"file","resource_name":"/etc/motd"}}
+{"time":"2017-11-01T10:00:05Z","event":"recipe_failed","payload":{"path":"/tmp/packer-itamae/default.rb"}}
+`
+
+func TestProvisionerPrepare_ReportEvents(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	configFile, err := ioutil.TempFile("", "config.yml")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(configFile.Name())
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["report_events"] = true
+	config["config_file"] = configFile.Name()
+
+	_, err = configFile.WriteString("log_level: debug\nhandlers:\n  - type: debug\n")
+	if err != nil {
+		t.Fatalf("unable to write temporary file: %s", err)
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if config_file already defines handlers")
+	}
+
+	p = Provisioner{}
+
+	configFile.Truncate(0)
+	configFile.Seek(0, 0)
+	configFile.WriteString("log_level: debug\n")
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if p.config.eventsConfig != "log_level: debug\n" {
+		t.Errorf("incorrect Itamae configuration, given %q, want %q",
+			p.config.eventsConfig, "log_level: debug\n")
+	}
+}
+
+func TestProvisionerProvision_ReportEvents(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["report_events"] = true
+	config["ignore_exit_codes"] = true
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(nil)
+	comm.DownloadData = testEvents
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	configPath := filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultEventsConfigName))
+	eventsPath := filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultEventsFileName))
+
+	if comm.UploadPath != configPath {
+		t.Errorf("incorrect upload path, given %s, want %s", comm.UploadPath, configPath)
+	}
+
+	if ok := strings.Contains(comm.UploadData, "path: '"+eventsPath+"'"); !ok {
+		t.Errorf("should configure JSON handler, but got: %s", comm.UploadData)
+	}
+
+	if comm.DownloadPath != eventsPath {
+		t.Errorf("incorrect download path, given %s, want %s", comm.DownloadPath, eventsPath)
+	}
+
+	commands := testItamaeCommands(comm.Commands)
+	if len(commands) != 1 || !strings.Contains(commands[0], "--config='"+configPath+"'") {
+		t.Errorf("should use generated configuration, but got: %v", commands)
+	}
+
+	expected := []string{
+		"Itamae resources: 1 updated, 1 skipped, 1 failed",
+		"Recipe /tmp/packer-itamae/default.rb: 5s (1 updated, 0 skipped, 1 failed)",
+		"Recipe /tmp/packer-itamae/nested.rb: 1s (0 updated, 1 skipped, 0 failed)",
+		"Failed resource: file[/etc/motd] in /tmp/packer-itamae/default.rb",
+	}
+
+	for _, message := range expected {
+		message = strings.Replace(message, ",", "%!(PACKER_COMMA)", -1)
+		if ok := strings.Contains(buffer.String(), message); !ok {
+			t.Errorf("should include %q, but got: %s", message, buffer)
+		}
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	events, err := parseEvents([]byte(`{"time":1509530400.5,"event":"recipe_started","payload":{"path":"a.rb"}}`))
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if len(events) != 1 || events[0].Time.UnixNano() != 1509530400500000000 {
+		t.Errorf("incorrect events, given %v", events)
+	}
+
+	_, err = parseEvents([]byte("{\"event\":\"recipe_started\"}\nnot json\n"))
+	if err == nil {
+		t.Errorf("should be an error if events are not valid JSON")
+	}
+}
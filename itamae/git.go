@@ -0,0 +1,137 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//
+	DefaultGitCommand = "git"
+
+	//
+	DefaultGitRef = "HEAD"
+)
+
+//
+type GitSource struct {
+	//
+	URL string `mapstructure:"url"`
+
+	//
+	Ref string `mapstructure:"ref"`
+
+	//
+	Subdirectory string `mapstructure:"subdirectory"`
+}
+
+//
+func (p *Provisioner) fetchGitSource(source *GitSource) (string, string, error) {
+	if source.URL == "" {
+		return "", "", fmt.Errorf("source_git: url must be specified")
+	}
+
+	if source.Ref == "" {
+		source.Ref = DefaultGitRef
+	}
+
+	dir, err := ioutil.TempDir("", "packer-itamae-git")
+	if err != nil {
+		return "", "", fmt.Errorf("source_git: unable to create temporary directory: %s", err)
+	}
+	p.tempDirs = append(p.tempDirs, dir)
+
+	repository := filepath.Join(dir, "repository")
+	if _, err := runGit("", "clone", "--quiet", "--bare", source.URL, repository); err != nil {
+		return "", "", fmt.Errorf("source_git: unable to clone %s: %s", source.URL, err)
+	}
+
+	commit, err := runGit(repository, "rev-parse", "--verify", "--quiet", source.Ref+"^{commit}")
+	if err != nil {
+		return "", "", fmt.Errorf("source_git: unable to resolve ref %s: %s", source.Ref, err)
+	}
+	commit = strings.TrimSpace(commit)
+
+	log.Printf("Resolved ref %s of %s to commit %s", source.Ref, source.URL, commit)
+
+	tree := filepath.Join(dir, "source")
+	if err := exportGitTree(repository, commit, tree); err != nil {
+		return "", "", fmt.Errorf("source_git: unable to export commit %s: %s", commit, err)
+	}
+
+	if err := os.RemoveAll(repository); err != nil {
+		return "", "", err
+	}
+
+	path := tree
+	if source.Subdirectory != "" {
+		path = filepath.Join(tree, filepath.FromSlash(source.Subdirectory))
+		if !withinDir(tree, path) {
+			return "", "", fmt.Errorf("source_git: subdirectory %s is outside of the repository", source.Subdirectory)
+		}
+	}
+	return path, commit, nil
+}
+
+//
+func exportGitTree(repository, commit, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(DefaultGitCommand, "--git-dir", repository, "archive", "--format=tar", commit)
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if err := extractTar(stdout, dst); err != nil {
+		if kerr := cmd.Process.Kill(); kerr != nil {
+			log.Printf("Unable to stop git archive: %s", kerr)
+		}
+		if werr := cmd.Wait(); werr != nil {
+			log.Printf("Git archive exited with error: %s", werr)
+		}
+		return err
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+//
+func runGit(repository string, args ...string) (string, error) {
+	if repository != "" {
+		args = append([]string{"--git-dir", repository}, args...)
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(DefaultGitCommand, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%s: %s", err, message)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
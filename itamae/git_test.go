@@ -0,0 +1,182 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testGitRepository(t *testing.T, files map[string]string) string {
+	if _, err := exec.LookPath(DefaultGitCommand); err != nil {
+		t.Skipf("unable to find git: %s", err)
+	}
+
+	directory := testDirectory(t, files)
+
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "--all"},
+		{"-c", "user.name=Packer", "-c", "user.email=packer@localhost", "commit", "--quiet", "-m", "Initial commit"},
+		{"tag", "v1.0.0"},
+	} {
+		cmd := exec.Command(DefaultGitCommand, args...)
+		cmd.Dir = directory
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("unable to run git %s: %s: %s", args[0], err, output)
+		}
+	}
+	return directory
+}
+
+func testGitCommit(t *testing.T, directory, ref string) string {
+	cmd := exec.Command(DefaultGitCommand, "rev-parse", ref)
+	cmd.Dir = directory
+
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("unable to run git rev-parse: %s", err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestProvisionerPrepare_SourceGit(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	repository := testGitRepository(t, map[string]string{
+		"README.md":              "",
+		"itamae/default.rb":      "",
+		"itamae/nginx/ssl.rb":    "",
+		"itamae/nginx/vhosts.rb": "",
+	})
+	defer os.RemoveAll(repository)
+
+	config["source_git"] = map[string]interface{}{
+		"url":          "file://" + filepath.ToSlash(repository),
+		"ref":          "v1.0.0",
+		"subdirectory": "itamae",
+	}
+
+	config["recipes"] = []string{
+		"default.rb",
+		"nginx",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	expected := testGitCommit(t, repository, "v1.0.0")
+	if p.sourceCommit != expected {
+		t.Errorf("incorrect commit, given: \"%v\", want \"%v\"", p.sourceCommit, expected)
+	}
+
+	defer p.removeTempDirs()
+
+	if _, err := os.Stat(filepath.Join(p.config.SourceDir, "nginx", "ssl.rb")); err != nil {
+		t.Errorf("should export repository, but got: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(p.config.SourceDir, "..", ".git")); err == nil {
+		t.Errorf("should not export repository metadata")
+	}
+
+	for key, value := range map[string]interface{}{
+		"ref":          "does-not-exist",
+		"url":          filepath.Join(repository, "does-not-exist"),
+		"subdirectory": "../..",
+	} {
+		p = Provisioner{}
+
+		source := map[string]interface{}{
+			"url":          repository,
+			"ref":          "HEAD",
+			"subdirectory": "itamae",
+		}
+		source[key] = value
+
+		config["source_git"] = source
+		err = p.Prepare(config)
+		if err == nil {
+			t.Errorf("should be an error if source_git has an invalid %s", key)
+		}
+
+		if len(p.tempDirs) != 0 {
+			t.Errorf("should remove temporary directories, but got: %v", p.tempDirs)
+		}
+	}
+
+	p = Provisioner{}
+
+	config["source_directory"] = repository
+	config["source_git"] = map[string]interface{}{
+		"url": repository,
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if both source_directory and source_git are set")
+	}
+}
+
+func TestProvisionerProvision_SourceGit(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	comm := testCommunicator()
+	config := testConfig()
+
+	repository := testGitRepository(t, map[string]string{
+		"default.rb": "",
+	})
+	defer os.RemoveAll(repository)
+
+	config["source_git"] = map[string]interface{}{
+		"url": repository,
+	}
+
+	config["recipes"] = []string{
+		"default.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	commit := testGitCommit(t, repository, "HEAD")
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := "Using source from " + repository + " at commit " + commit
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include commit, but got: %s", buffer)
+	}
+
+	expected = "PACKER_SOURCE_GIT_COMMIT='" + commit + "'"
+	if ok := strings.Contains(comm.StartCmd.Command, expected); !ok {
+		t.Errorf("incorrect execute_command, given: \"%v\", want \"%v\"",
+			comm.StartCmd.Command, expected)
+	}
+
+	source := strings.TrimSuffix(comm.UploadDirSrc, "/")
+	if ok := strings.HasPrefix(source, os.TempDir()); !ok {
+		t.Errorf("incorrect source directory, given: \"%v\"", comm.UploadDirSrc)
+	}
+
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("should remove exported source directory %s", source)
+	}
+}
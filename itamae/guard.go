@@ -0,0 +1,56 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+//
+func (p *Provisioner) skipProvisioning(ui packer.Ui, comm packer.Communicator) (bool, error) {
+	guards := []struct {
+		name    string
+		command string
+		skip    func(int) bool
+	}{
+		{"skip_if", p.config.SkipIf, func(status int) bool { return status == 0 }},
+		{"only_if", p.config.OnlyIf, func(status int) bool { return status != 0 }},
+	}
+
+	for _, guard := range guards {
+		if guard.command == "" {
+			continue
+		}
+
+		ui.Message(fmt.Sprintf("Evaluating %s guard: %s", guard.name, guard.command))
+
+		status, err := p.runGuard(ui, comm, guard.command)
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", guard.name, err)
+		}
+
+		if guard.skip(status) {
+			ui.Message(fmt.Sprintf("Guard %s exited with status %d, skipping provisioning...",
+				guard.name, status))
+			p.machine(ui, "guard", "skip", guard.name, strconv.Itoa(status))
+			return true, nil
+		}
+
+		ui.Message(fmt.Sprintf("Guard %s exited with status %d, continuing provisioning...",
+			guard.name, status))
+		p.machine(ui, "guard", "run", guard.name, strconv.Itoa(status))
+	}
+	return false, nil
+}
+
+//
+func (p *Provisioner) runGuard(ui packer.Ui, comm packer.Communicator, command string) (int, error) {
+	cmd := &packer.RemoteCmd{
+		Command: command,
+	}
+	if err := cmd.StartWithUi(comm, ui); err != nil {
+		return 0, err
+	}
+	return cmd.ExitStatus, nil
+}
@@ -0,0 +1,92 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerProvision_Guards(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["skip_if"] = "test -f /etc/baked-by-itamae"
+	config["only_if"] = "command -v ruby"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	testCases := []struct {
+		skipIf, onlyIf int
+		provisioned    bool
+		message        string
+	}{
+		{0, 0, false, "Guard skip_if exited with status 0%!(PACKER_COMMA) skipping provisioning..."},
+		{1, 1, false, "Guard only_if exited with status 1%!(PACKER_COMMA) skipping provisioning..."},
+		{1, 0, true, "Guard only_if exited with status 0%!(PACKER_COMMA) continuing provisioning..."},
+	}
+
+	for _, tc := range testCases {
+		buffer.Reset()
+
+		comm := testCommandCommunicator(func(command string) (string, int) {
+			switch command {
+			case config["skip_if"]:
+				return "", tc.skipIf
+			case config["only_if"]:
+				return "", tc.onlyIf
+			}
+			return "", 0
+		})
+
+		err = p.Provision(ui, comm)
+		if err != nil {
+			t.Errorf("should not error, but got: %s", err)
+		}
+
+		if comm.Commands[0] != config["skip_if"] {
+			t.Errorf("should evaluate guards first, but got: %s", comm.Commands[0])
+		}
+
+		if attempts := testInstallAttempts(comm.Commands); (attempts == 1) != tc.provisioned {
+			t.Errorf("incorrect number of install attempts for %+v, given %d", tc, attempts)
+		}
+
+		if commands := testItamaeCommands(comm.Commands); (len(commands) == 1) != tc.provisioned {
+			t.Errorf("incorrect number of runs for %+v, given %d", tc, len(commands))
+		}
+
+		if ok := strings.Contains(buffer.String(), tc.message); !ok {
+			t.Errorf("should include %q, but got: %s", tc.message, buffer)
+		}
+	}
+
+	comm := testCommandCommunicator(nil)
+	comm.StartError = func(command string) error {
+		return os.ErrClosed
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error evaluating guard: skip_if") {
+		t.Errorf("should be an error if the guard cannot run, but got: %v", err)
+	}
+}
@@ -3,6 +3,10 @@ package itamaelocal
 import (
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
 
 	"github.com/hashicorp/packer/packer"
 )
@@ -23,3 +27,67 @@ func testUI(writer io.Writer) *packer.MachineReadableUi {
 func testCommunicator() *packer.MockCommunicator {
 	return &packer.MockCommunicator{}
 }
+
+type recordingCommunicator struct {
+	packer.MockCommunicator
+
+	sync.Mutex
+
+	Commands   []string
+	Handler    func(string) (string, int)
+	StartError func(string) error
+}
+
+func (c *recordingCommunicator) Start(rc *packer.RemoteCmd) error {
+	c.Lock()
+	c.StartCalled = true
+	c.StartCmd = rc
+	c.Commands = append(c.Commands, rc.Command)
+	c.Unlock()
+
+	if c.StartError != nil {
+		if err := c.StartError(rc.Command); err != nil {
+			return err
+		}
+	}
+
+	var stdout string
+	var status int
+
+	if c.Handler != nil {
+		stdout, status = c.Handler(rc.Command)
+	}
+
+	go func() {
+		if rc.Stdout != nil && stdout != "" {
+			rc.Stdout.Write([]byte(stdout))
+		}
+		rc.SetExited(status)
+	}()
+	return nil
+}
+
+func testCommandCommunicator(handler func(string) (string, int)) *recordingCommunicator {
+	return &recordingCommunicator{
+		Handler: handler,
+	}
+}
+
+func testDirectory(t *testing.T, files map[string]string) string {
+	directory, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(directory, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unable to create temporary directory: %s", err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to create temporary file: %s", err)
+		}
+	}
+	return directory
+}
@@ -0,0 +1,62 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+var (
+	//
+	changedResourceRegexp = regexp.MustCompile(`(\w+\[[^\]]*\])\s+\S+\s+will change from`)
+)
+
+//
+func (p *Provisioner) verifyIdempotency(ui packer.Ui, comm packer.Communicator) error {
+	if p.config.VerifyIdempotencyDryRun {
+		ui.Message("Verifying idempotency with a dry run of Itamae...")
+	} else {
+		ui.Message("Verifying idempotency with a second run of Itamae...")
+	}
+
+	run, err := p.runItamae(ui, comm, p.config.VerifyIdempotencyDryRun)
+	if err != nil {
+		return err
+	}
+
+	if run.status == 2 {
+		resources := changedResources(run.output)
+		if len(resources) == 0 {
+			return fmt.Errorf("Recipes are not idempotent, resources were changed on the second run. " +
+				"See output above for more information.")
+		}
+
+		for _, resource := range resources {
+			ui.Error(fmt.Sprintf("Resource changed on the second run: %s", resource))
+		}
+		return fmt.Errorf("Recipes are not idempotent, %d resource(s) changed on the second run: %s",
+			len(resources), strings.Join(resources, ", "))
+	}
+
+	if p.config.IgnoreExitCodes {
+		return nil
+	}
+	return p.validateExitStatus(run.status, p.config.ValidExitCodes)
+}
+
+//
+func changedResources(output string) []string {
+	seen := make(map[string]bool)
+	resources := make([]string, 0)
+
+	for _, matches := range changedResourceRegexp.FindAllStringSubmatch(output, -1) {
+		if seen[matches[1]] {
+			continue
+		}
+		seen[matches[1]] = true
+		resources = append(resources, matches[1])
+	}
+	return resources
+}
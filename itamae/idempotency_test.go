@@ -0,0 +1,165 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerProvision_VerifyIdempotency(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["verify_idempotency"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	runs := 0
+	second := 0
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if !strings.Contains(command, "itamae local") {
+			return "", 0
+		}
+
+		runs++
+		if runs == 1 {
+			return " INFO :     file[/etc/motd] content will change from 'a' to 'b'\n", 2
+		}
+
+		if second == 2 {
+			return strings.Join([]string{
+				" INFO :     file[/etc/motd] content will change from 'b' to 'c'",
+				" INFO :     service[nginx] running will change from 'false' to 'true'",
+			}, "\n"), 2
+		}
+		return "", second
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if runs != 2 {
+		t.Errorf("incorrect number of runs, given %d, want %d", runs, 2)
+	}
+
+	if ok := strings.Contains(comm.StartCmd.Command, "--dry-run"); ok {
+		t.Errorf("should not include --dry-run, but got: %s", comm.StartCmd.Command)
+	}
+
+	runs = 0
+	second = 2
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if second run changed resources")
+	}
+
+	for _, expected := range []string{"file[/etc/motd]", "service[nginx]"} {
+		if err != nil && !strings.Contains(err.Error(), expected) {
+			t.Errorf("should include %s, but got: %s", expected, err)
+		}
+
+		if ok := strings.Contains(buffer.String(), "Resource changed on the second run: "+expected); !ok {
+			t.Errorf("should report %s, but got: %s", expected, buffer)
+		}
+	}
+
+	runs = 0
+	second = 1
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if second run failed")
+	}
+}
+
+func TestProvisionerProvision_VerifyIdempotencyDryRun(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	ui := testUI(nil)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["verify_idempotency"] = true
+	config["verify_idempotency_dry_run"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(nil)
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	commands := make([]string, 0)
+	for _, command := range comm.Commands {
+		if strings.Contains(command, "itamae local") {
+			commands = append(commands, command)
+		}
+	}
+
+	if len(commands) != 2 {
+		t.Fatalf("incorrect number of runs, given %d, want %d", len(commands), 2)
+	}
+
+	expected := strings.Replace(commands[0], "--detailed-exitcode ", "--detailed-exitcode --dry-run ", 1)
+	if commands[1] != expected {
+		t.Errorf("incorrect execute_command, given: \"%v\", want \"%v\"", commands[1], expected)
+	}
+}
+
+func TestChangedResources(t *testing.T) {
+	output := strings.Join([]string{
+		" INFO : Recipe: /tmp/packer-itamae/default.rb",
+		" INFO :   package[nginx] installed will change from 'false' to 'true'",
+		" INFO :   file[/etc/nginx/nginx.conf] exist? will change from 'false' to 'true'",
+		" INFO :   file[/etc/nginx/nginx.conf] content will change from '' to 'worker_processes 1;'",
+		" INFO :   service[nginx] executed 'start'",
+	}, "\n")
+
+	expected := []string{
+		"package[nginx]",
+		"file[/etc/nginx/nginx.conf]",
+	}
+
+	resources := changedResources(output)
+	if ok := reflect.DeepEqual(resources, expected); !ok {
+		t.Errorf("value given %v, want %v", resources, expected)
+	}
+}
@@ -0,0 +1,80 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	DefaultInlineRecipeName = "packer-inline-recipe.rb"
+)
+
+//
+func decodeInlineRecipe(value interface{}) ([]string, error) {
+	var lines []string
+
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		lines = strings.Split(v, "\n")
+	case []uint8:
+		lines = strings.Split(string(v), "\n")
+	case []string:
+		lines = v
+	case []interface{}:
+		for idx, line := range v {
+			switch l := line.(type) {
+			case string:
+				lines = append(lines, l)
+			case []uint8:
+				lines = append(lines, string(l))
+			default:
+				return nil, fmt.Errorf("inline_recipe[%d]: must be a string, got %T", idx, line)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("inline_recipe: must be a string or a list of strings, got %T", value)
+	}
+
+	if strings.TrimSpace(strings.Join(lines, "")) == "" {
+		return nil, fmt.Errorf("inline_recipe: cannot be empty")
+	}
+	return lines, nil
+}
+
+//
+func (p *Provisioner) uploadInlineRecipe(ui packer.Ui, comm packer.Communicator) error {
+	dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultInlineRecipeName))
+	content := strings.Join(p.config.inlineRecipe, "\n") + "\n"
+
+	ui.Message(fmt.Sprintf("Uploading inline recipe: %s", DefaultInlineRecipeName))
+	p.machine(ui, "upload", "file", DefaultInlineRecipeName, dst)
+	return comm.Upload(dst, strings.NewReader(content), nil)
+}
+
+//
+func (p *Provisioner) inlineRecipeErrors(output string) []string {
+	pattern := regexp.MustCompile(regexp.QuoteMeta(DefaultInlineRecipeName) + `:(\d+)`)
+
+	seen := make(map[int]bool)
+	messages := make([]string, 0)
+
+	for _, matches := range pattern.FindAllStringSubmatch(output, -1) {
+		line, err := strconv.Atoi(matches[1])
+		if err != nil || line < 1 || line > len(p.config.inlineRecipe) || seen[line] {
+			continue
+		}
+		seen[line] = true
+
+		messages = append(messages, fmt.Sprintf("inline_recipe line %d: %s",
+			line, strings.TrimSpace(p.config.inlineRecipe[line-1])))
+	}
+	return messages
+}
@@ -0,0 +1,150 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_InlineRecipe(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	config["inline_recipe"] = "package 'nginx'\nservice 'nginx' do\n  action :start\nend"
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := []string{
+		"package 'nginx'",
+		"service 'nginx' do",
+		"  action :start",
+		"end",
+	}
+
+	if ok := reflect.DeepEqual(p.config.inlineRecipe, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.inlineRecipe, expected)
+	}
+
+	p = Provisioner{}
+
+	config["inline_recipe"] = []interface{}{
+		"package 'nginx', version: '1.14.0'",
+		"service 'nginx'",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected = []string{
+		"package 'nginx', version: '1.14.0'",
+		"service 'nginx'",
+	}
+
+	if ok := reflect.DeepEqual(p.config.inlineRecipe, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.inlineRecipe, expected)
+	}
+
+	p = Provisioner{}
+
+	config["inline_recipe"] = 123
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if inline_recipe is not a string or a list")
+	}
+
+	p = Provisioner{}
+
+	config["inline_recipe"] = []interface{}{"", " "}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if inline_recipe is empty")
+	}
+}
+
+func TestProvisionerProvision_InlineRecipe(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	comm := testCommandCommunicator(nil)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["inline_recipe"] = []interface{}{
+		"package 'nginx'",
+		"service 'nginx'",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultInlineRecipeName))
+	if comm.UploadPath != expected {
+		t.Errorf("incorrect upload path, given: \"%v\", want \"%v\"",
+			comm.UploadPath, expected)
+	}
+
+	expected = "package 'nginx'\nservice 'nginx'\n"
+	if comm.UploadData != expected {
+		t.Errorf("incorrect inline recipe, given: \"%v\", want \"%v\"",
+			comm.UploadData, expected)
+	}
+
+	expected = recipeFile.Name() + " " + DefaultInlineRecipeName
+	if ok := strings.HasSuffix(comm.StartCmd.Command, expected); !ok {
+		t.Errorf("incorrect execute_command, given: \"%v\", want \"%v\"",
+			comm.StartCmd.Command, expected)
+	}
+
+	expected = "Uploading inline recipe: " + DefaultInlineRecipeName
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include inline recipe name, but got: %s", buffer)
+	}
+
+	buffer.Reset()
+
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return DefaultInlineRecipeName + ":2: undefined method `servce'\n", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if inline recipe fails")
+	}
+
+	expected = "inline_recipe line 2: service 'nginx'"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should map error back to inline recipe, but got: %s", buffer)
+	}
+}
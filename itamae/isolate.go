@@ -0,0 +1,155 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+//
+type recipeRun struct {
+	recipe   string
+	status   int
+	changed  bool
+	duration time.Duration
+	err      error
+	skipped  bool
+	resumed  bool
+}
+
+//
+func (p *Provisioner) executeIsolated(ui packer.Ui, comm packer.Communicator, dryRun bool) error {
+	return p.collectJUnitReport(ui, func() error {
+		return p.executeIsolatedRecipes(ui, comm, dryRun)
+	})
+}
+
+//
+func (p *Provisioner) executeIsolatedRecipes(ui packer.Ui, comm packer.Communicator, dryRun bool) error {
+	recipes := p.recipes()
+	defer func() {
+		p.isolatedRecipe = ""
+	}()
+
+	results := make([]*recipeRun, 0, len(recipes))
+
+	var c *checkpoint
+	if !dryRun {
+		c = p.loadCheckpoint(ui, comm)
+	}
+
+	reboots := 0
+
+	failed := false
+	for idx, recipe := range recipes {
+		result := &recipeRun{
+			recipe: recipe,
+			status: -1,
+		}
+		results = append(results, result)
+
+		if failed && !p.config.ContinueOnError {
+			result.skipped = true
+			continue
+		}
+
+		var sum string
+		if c != nil {
+			sum = p.recipeChecksum(recipe)
+			if c.completed(p.checkpointName(recipe), sum) {
+				ui.Message(fmt.Sprintf("Skipping recipe %d of %d: %s, completed in a previous attempt",
+					idx+1, len(recipes), recipe))
+				p.machine(ui, "recipe", "resume", recipe)
+				result.resumed = true
+				continue
+			}
+		}
+
+		ui.Message(fmt.Sprintf("Executing recipe %d of %d: %s", idx+1, len(recipes), recipe))
+		p.machine(ui, "recipe", "start", recipe)
+
+		p.isolatedRecipe = recipe
+
+		start := time.Now()
+		run, err := p.executeItamaeRun(ui, comm, dryRun)
+		result.duration = time.Since(start)
+		result.err = err
+
+		if run != nil {
+			result.status = run.status
+			result.changed = run.status == 2
+		}
+
+		p.machine(ui, "recipe", "end", recipe, strconv.Itoa(result.status), machineResult(err))
+		if err != nil {
+			failed = true
+			continue
+		}
+
+		if c != nil && sum != "" {
+			c.add(p.checkpointName(recipe), sum)
+			if err := p.saveCheckpoint(comm, c); err != nil {
+				ui.Error(fmt.Sprintf("Unable to save checkpoint: %s", err))
+			}
+		}
+
+		//
+		if p.config.RebootOnRequest && !dryRun {
+			if _, err := p.rebootIfRequested(ui, comm, &reboots); err != nil {
+				p.reportRecipeRuns(ui, results)
+				return err
+			}
+		}
+	}
+
+	p.reportRecipeRuns(ui, results)
+
+	failures := make([]string, 0)
+	for _, result := range results {
+		if result.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", result.recipe, result.err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d recipes failed:\n%s",
+			len(failures), len(recipes), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+//
+func (p *Provisioner) reportRecipeRuns(ui packer.Ui, results []*recipeRun) {
+	var buffer bytes.Buffer
+
+	w := tabwriter.NewWriter(&buffer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Recipe\tExit code\tChanged\tDuration")
+	for _, result := range results {
+		if result.skipped || result.resumed {
+			state := "skipped"
+			if result.resumed {
+				state = "resumed"
+			}
+			fmt.Fprintf(w, "%s\t-\t-\t%s\n", result.recipe, state)
+			continue
+		}
+
+		status := "-"
+		if result.status > -1 {
+			status = strconv.Itoa(result.status)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", result.recipe, status, result.changed,
+			result.duration.Round(time.Millisecond))
+	}
+	w.Flush()
+
+	ui.Message("Recipe results:")
+	for _, line := range strings.Split(strings.TrimRight(buffer.String(), "\n"), "\n") {
+		ui.Message(line)
+	}
+}
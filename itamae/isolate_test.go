@@ -0,0 +1,130 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_IsolateRecipes(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb": "",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{"base.rb"}
+
+	config["isolate_recipes"] = true
+	config["continue_on_error"] = true
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	p = Provisioner{}
+
+	config["isolate_recipes"] = false
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if continue_on_error is set without isolate_recipes")
+	}
+}
+
+func TestProvisionerProvision_IsolateRecipes(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb": "",
+		"app.rb":  "",
+		"web.rb":  "",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{"base.rb", "app.rb", "web.rb"}
+	config["isolate_recipes"] = true
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	handler := func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			switch {
+			case strings.HasSuffix(command, "app.rb"):
+				return "", 1
+			case strings.HasSuffix(command, "web.rb"):
+				return "", 2
+			}
+		}
+		return "", 0
+	}
+
+	comm := testCommandCommunicator(handler)
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 recipes failed") {
+		t.Errorf("should be an error listing failed recipes, but got: %v", err)
+	}
+
+	commands := testItamaeCommands(comm.Commands)
+	if len(commands) != 2 {
+		t.Fatalf("incorrect number of runs, given %d, want %d", len(commands), 2)
+	}
+
+	if !strings.HasSuffix(commands[0], "--detailed-exitcode base.rb") {
+		t.Errorf("should execute a single recipe, but got: %s", commands[0])
+	}
+
+	expected := []string{
+		"Recipe results:",
+		"base.rb  0          false",
+		"app.rb   1          false",
+		"web.rb   -          -        skipped",
+	}
+
+	for _, line := range expected {
+		if ok := strings.Contains(buffer.String(), line); !ok {
+			t.Errorf("should include %q, but got: %s", line, buffer)
+		}
+	}
+
+	p = Provisioner{}
+	buffer.Reset()
+
+	config["continue_on_error"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	comm = testCommandCommunicator(handler)
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "app.rb: Exit status 1") {
+		t.Errorf("should be an error listing failed recipes, but got: %v", err)
+	}
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 3 {
+		t.Errorf("incorrect number of runs, given %d, want %d", len(commands), 3)
+	}
+
+	if ok := strings.Contains(buffer.String(), "web.rb   2          true"); !ok {
+		t.Errorf("should report changed recipes, but got: %s", buffer)
+	}
+}
@@ -0,0 +1,233 @@
+package itamaelocal
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	DefaultJUnitSuiteName = "itamae"
+)
+
+//
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	TestCases []junitTestCase `xml:"testcase"`
+	SystemOut string          `xml:"system-out,omitempty"`
+
+	duration time.Duration
+}
+
+//
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+//
+type junitFailure struct {
+	Message  string `xml:"message,attr"`
+	Type     string `xml:"type,attr"`
+	Contents string `xml:",chardata"`
+}
+
+//
+func (s *junitTestSuite) add(testCase junitTestCase) {
+	s.TestCases = append(s.TestCases, testCase)
+	s.Tests++
+	if testCase.Failure != nil {
+		s.Failures++
+	}
+}
+
+//
+func (s *junitTestSuite) merge(other *junitTestSuite) {
+	if s.Timestamp == "" {
+		s.Timestamp = other.Timestamp
+	}
+
+	for _, testCase := range other.TestCases {
+		s.add(testCase)
+	}
+
+	s.duration += other.duration
+	s.Time = junitSeconds(s.duration)
+	s.SystemOut += other.SystemOut
+}
+
+//
+func (p *Provisioner) collectJUnitReport(ui packer.Ui, f func() error) error {
+	if p.config.ReportJUnit == "" || p.junitSuite != nil {
+		return f()
+	}
+
+	p.junitSuite = p.junitTestSuite(nil, nil)
+	defer func() {
+		p.junitSuite = nil
+	}()
+
+	err := f()
+	if rerr := p.saveJUnitReport(ui, p.junitSuite); rerr != nil && err == nil {
+		return rerr
+	}
+	return err
+}
+
+//
+func (p *Provisioner) writeJUnitReport(ui packer.Ui, run *itamaeRun, runErr error) error {
+	suite := p.junitTestSuite(run, runErr)
+
+	//
+	if p.junitSuite != nil {
+		p.junitSuite.merge(suite)
+		return nil
+	}
+	return p.saveJUnitReport(ui, suite)
+}
+
+//
+func (p *Provisioner) saveJUnitReport(ui packer.Ui, suite *junitTestSuite) error {
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err == nil {
+		data = append([]byte(xml.Header), append(data, '\n')...)
+		err = ioutil.WriteFile(p.config.ReportJUnit, data, 0644)
+	}
+
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to write JUnit report %s: %s", p.config.ReportJUnit, err))
+		return fmt.Errorf("Error writing JUnit report: %s", err)
+	}
+
+	ui.Message(fmt.Sprintf("JUnit report written to: %s", p.config.ReportJUnit))
+	return nil
+}
+
+//
+func (p *Provisioner) junitTestSuite(run *itamaeRun, runErr error) *junitTestSuite {
+	suite := &junitTestSuite{
+		Name: DefaultJUnitSuiteName,
+		Time: junitSeconds(0),
+	}
+
+	if p.config.PackerBuildName != "" {
+		suite.Name = fmt.Sprintf("%s.%s", DefaultJUnitSuiteName, p.config.PackerBuildName)
+	}
+
+	var output string
+
+	if run != nil {
+		output = run.output
+
+		suite.duration = run.duration
+		suite.Time = junitSeconds(run.duration)
+		suite.Timestamp = run.start.UTC().Format("2006-01-02T15:04:05")
+		suite.SystemOut = output
+
+		for _, recipe := range summarizeEvents(run.events) {
+			testCase := junitTestCase{
+				Name:      recipe.path,
+				ClassName: "recipe",
+				Time:      junitSeconds(recipe.duration),
+			}
+
+			if recipe.failed {
+				testCase.Failure = &junitFailure{
+					Message:  fmt.Sprintf("Recipe %s failed", recipe.path),
+					Type:     "recipe_failed",
+					Contents: failureOutput(output),
+				}
+			}
+			suite.add(testCase)
+
+			for _, resource := range recipe.resources {
+				testCase := junitTestCase{
+					Name:      resource.name,
+					ClassName: recipe.path,
+					Time:      junitSeconds(resource.duration),
+				}
+
+				if resource.status == "failed" {
+					testCase.Failure = &junitFailure{
+						Message:  fmt.Sprintf("Resource %s failed", resource.name),
+						Type:     "resource_failed",
+						Contents: failureOutput(output),
+					}
+				}
+				suite.add(testCase)
+			}
+		}
+	}
+
+	if runErr != nil && suite.Failures == 0 {
+		name := "itamae local"
+		if p.isolatedRecipe != "" {
+			name = p.isolatedRecipe
+		}
+
+		suite.add(junitTestCase{
+			Name:      name,
+			ClassName: DefaultJUnitSuiteName,
+			Time:      suite.Time,
+			Failure: &junitFailure{
+				Message:  runErr.Error(),
+				Type:     "execution_failed",
+				Contents: failureOutput(output),
+			},
+		})
+	}
+	return suite
+}
+
+//
+func validateReportPathConfig(path, config string) error {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return fmt.Errorf("%s: %s must point to a file", config, path)
+	}
+
+	dir := filepath.Dir(path)
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %s is invalid: %s", config, path, err)
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: %s is invalid: %s is not a directory", config, path, dir)
+	}
+	return nil
+}
+
+//
+func failureOutput(output string) string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, "ERROR") {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) == 0 {
+		return output
+	}
+	return strings.Join(lines, "\n")
+}
+
+//
+func junitSeconds(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
@@ -0,0 +1,214 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_ReportJUnit(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	directory, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["report_junit"] = filepath.Join(directory, "missing", "report.xml")
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if report_junit directory does not exist")
+	}
+
+	p = Provisioner{}
+
+	config["report_junit"] = directory
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if report_junit is a directory")
+	}
+
+	p = Provisioner{}
+
+	config["report_junit"] = filepath.Join(directory, "report.xml")
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+}
+
+func TestProvisionerProvision_ReportJUnit(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	directory, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	report := filepath.Join(directory, "report.xml")
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["report_junit"] = report
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return " INFO : Recipe: default.rb\nERROR :   file[/etc/motd] Failed.\n", 1
+		}
+		return "", 0
+	})
+	comm.DownloadData = testEvents
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if Itamae fails")
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatalf("should write JUnit report, but got: %s", err)
+	}
+
+	var suite junitTestSuite
+	if err := xml.Unmarshal(data, &suite); err != nil {
+		t.Fatalf("should write valid JUnit report, but got: %s", err)
+	}
+
+	if suite.Tests != 5 || suite.Failures != 2 {
+		t.Errorf("incorrect number of tests, given %d (%d failures), want %d (%d failures)",
+			suite.Tests, suite.Failures, 5, 2)
+	}
+
+	var failed *junitTestCase
+	for idx := range suite.TestCases {
+		if suite.TestCases[idx].Name == "file[/etc/motd]" {
+			failed = &suite.TestCases[idx]
+		}
+	}
+
+	if failed == nil || failed.Failure == nil {
+		t.Fatalf("should mark failed resource as a failure, but got: %s", data)
+	}
+
+	if failed.ClassName != "/tmp/packer-itamae/default.rb" || failed.Time != "1.000" {
+		t.Errorf("incorrect test case, given %s (%s), want %s (%s)",
+			failed.ClassName, failed.Time, "/tmp/packer-itamae/default.rb", "1.000")
+	}
+
+	if failed.Failure.Contents != "ERROR :   file[/etc/motd] Failed." {
+		t.Errorf("incorrect failure output, given %q", failed.Failure.Contents)
+	}
+}
+
+func TestProvisionerJUnitTestSuite_ExecutionError(t *testing.T) {
+	var p Provisioner
+
+	run := &itamaeRun{
+		status: 1,
+		output: "syntax error\n",
+	}
+
+	suite := p.junitTestSuite(run, p.validateExitStatus(1, DefaultValidExitCodes))
+	if suite.Tests != 1 || suite.Failures != 1 {
+		t.Fatalf("incorrect number of tests, given %d (%d failures), want %d (%d failures)",
+			suite.Tests, suite.Failures, 1, 1)
+	}
+
+	if suite.TestCases[0].Failure.Contents != "syntax error\n" {
+		t.Errorf("incorrect failure output, given %q", suite.TestCases[0].Failure.Contents)
+	}
+}
+
+func TestProvisionerProvision_ReportJUnitIsolated(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb": `package "curl"`,
+		"app.rb":  `package "nginx"`,
+	})
+	defer os.RemoveAll(directory)
+
+	report := filepath.Join(directory, "report.xml")
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{"base.rb", "app.rb"}
+	config["isolate_recipes"] = true
+	config["continue_on_error"] = true
+	config["report_junit"] = report
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") && strings.HasSuffix(command, "base.rb") {
+			return "", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(testUI(nil), comm)
+	if err == nil {
+		t.Errorf("should be an error if a recipe fails")
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatalf("should write JUnit report, but got: %s", err)
+	}
+
+	var suite junitTestSuite
+	if err := xml.Unmarshal(data, &suite); err != nil {
+		t.Fatalf("should write valid JUnit report, but got: %s", err)
+	}
+
+	if suite.Tests != 1 || suite.Failures != 1 {
+		t.Fatalf("incorrect number of tests, given %d (%d failures), want %d (%d failures)",
+			suite.Tests, suite.Failures, 1, 1)
+	}
+
+	if name := suite.TestCases[0].Name; name != "base.rb" {
+		t.Errorf("should name the failed recipe, given %s, want %s", name, "base.rb")
+	}
+}
@@ -0,0 +1,106 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//
+func (p *Provisioner) mergeSourceDirs(layers []string) (string, error) {
+	dir, err := ioutil.TempDir("", "packer-itamae-layers")
+	if err != nil {
+		return "", fmt.Errorf("source_directory: unable to create temporary directory: %s", err)
+	}
+	p.tempDirs = append(p.tempDirs, dir)
+
+	origins := make(map[string]string)
+
+	for idx, layer := range layers {
+		root, err := filepath.EvalSymlinks(layer)
+		if err != nil {
+			return "", fmt.Errorf("source_directory[%d]: %s is invalid: %s", idx, layer, err)
+		}
+
+		err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil || rel == "." {
+				return err
+			}
+
+			dst := filepath.Join(dir, rel)
+
+			if fi.IsDir() {
+				if dfi, err := os.Lstat(dst); err == nil && !dfi.IsDir() {
+					return fmt.Errorf("%s is a directory, but a file in %s", path, origins[rel])
+				}
+				return os.MkdirAll(dst, 0755)
+			}
+
+			if dfi, err := os.Lstat(dst); err == nil {
+				if dfi.IsDir() {
+					return fmt.Errorf("%s is a file, but a directory in an earlier layer", path)
+				}
+
+				if err := os.Remove(dst); err != nil {
+					return err
+				}
+			}
+
+			if fi.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+
+				if err := os.Symlink(target, dst); err != nil {
+					return err
+				}
+			} else if fi.Mode().IsRegular() {
+				if err := copyFile(dst, path, fi.Mode()); err != nil {
+					return err
+				}
+			} else {
+				return nil
+			}
+
+			origins[rel] = layer
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("source_directory[%d]: unable to merge %s: %s", idx, layer, err)
+		}
+	}
+
+	paths := make([]string, 0, len(origins))
+	for rel := range origins {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		log.Printf("[DEBUG] Source file %s from layer %s", filepath.ToSlash(rel), origins[rel])
+	}
+	return dir, nil
+}
+
+//
+func copyFile(dst, src string, mode os.FileMode) (err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	return writeArchiveFile(dst, f, mode)
+}
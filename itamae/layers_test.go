@@ -0,0 +1,150 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_SourceDirectoryLayers(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	log.SetOutput(buffer)
+	defer log.SetOutput(ioutil.Discard)
+
+	config := testConfig()
+
+	base := testDirectory(t, map[string]string{
+		"default.rb":       "base",
+		"nginx/default.rb": "base",
+		"nginx/ssl.rb":     "base",
+		"node.json":        "{}",
+	})
+	defer os.RemoveAll(base)
+
+	team := testDirectory(t, map[string]string{
+		"nginx/ssl.rb": "team",
+		"team.rb":      "team",
+	})
+	defer os.RemoveAll(team)
+
+	config["source_directory"] = []string{
+		base,
+		team,
+	}
+
+	config["node_json"] = "node.json"
+	config["recipes"] = []string{
+		"**/*.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	defer p.removeTempDirs()
+
+	expected := []string{
+		"default.rb",
+		"nginx/default.rb",
+		"nginx/ssl.rb",
+		"team.rb",
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+
+	for name, layer := range map[string]string{"default.rb": "base", "nginx/ssl.rb": "team"} {
+		content, err := ioutil.ReadFile(filepath.Join(p.config.SourceDir, name))
+		if err != nil || string(content) != layer {
+			t.Errorf("incorrect content for %s, given \"%s\", want \"%s\"", name, content, layer)
+		}
+	}
+
+	for name, layer := range map[string]string{"default.rb": base, "nginx/ssl.rb": team} {
+		expected := "Source file " + name + " from layer " + layer
+		if ok := strings.Contains(buffer.String(), expected); !ok {
+			t.Errorf("should include layer of %s, but got: %s", name, buffer)
+		}
+	}
+
+	p = Provisioner{}
+
+	config["recipes"] = []string{
+		"team.rb",
+	}
+
+	config["source_directory"] = []string{
+		base,
+		"/does/not/exist",
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if a source_directory layer does not exist")
+	}
+
+	p = Provisioner{}
+
+	config["recipes"] = []string{
+		"default.rb",
+	}
+
+	config["source_directory"] = []string{
+		base,
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if p.config.SourceDir != base {
+		t.Errorf("value given %v, want %v", p.config.SourceDir, base)
+	}
+}
+
+func TestProvisionerPrepare_SourceDirectoryLayersConflict(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	base := testDirectory(t, map[string]string{
+		"nginx/default.rb": "",
+	})
+	defer os.RemoveAll(base)
+
+	team := testDirectory(t, map[string]string{
+		"nginx": "",
+	})
+	defer os.RemoveAll(team)
+
+	config["source_directory"] = []string{
+		base,
+		team,
+	}
+
+	config["recipes"] = []string{
+		"nginx/default.rb",
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if a file replaces a directory")
+	}
+
+	if len(p.tempDirs) != 0 {
+		t.Errorf("should remove temporary directories, but got: %v", p.tempDirs)
+	}
+}
@@ -0,0 +1,34 @@
+package itamaelocal
+
+import (
+	"strconv"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	MachineEventType = "itamae"
+)
+
+//
+func (p *Provisioner) machine(ui packer.Ui, phase, event string, args ...string) {
+	ui.Machine(MachineEventType, append([]string{phase, event}, args...)...)
+}
+
+//
+func (p *Provisioner) machineExecuteEnd(ui packer.Ui, run *itamaeRun) {
+	changed := "unchanged"
+	if run.status == 2 {
+		changed = "changed"
+	}
+	p.machine(ui, "execute", "end", strconv.Itoa(run.status), changed)
+}
+
+//
+func machineResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
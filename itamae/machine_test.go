@@ -0,0 +1,64 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerProvision_MachineEvents(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["clean_staging_directory"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return "", 2
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := []string{
+		",itamae,install,start,1",
+		",itamae,install,end,1,success",
+		fmt.Sprintf(",itamae,staging,create,%s", p.config.StagingDir),
+		fmt.Sprintf(",itamae,upload,file,%s,%s%s", recipeFile.Name(), p.config.StagingDir, recipeFile.Name()),
+		",itamae,execute,start,false",
+		",itamae,execute,end,2,changed",
+		fmt.Sprintf(",itamae,cleanup,end,%s", p.config.StagingDir),
+	}
+
+	for _, event := range expected {
+		if ok := strings.Contains(buffer.String(), event+"\n"); !ok {
+			t.Errorf("should include machine event %q, but got: %s", event, buffer)
+		}
+	}
+}
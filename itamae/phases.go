@@ -0,0 +1,198 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+//
+type Phase struct {
+	//
+	Name string `mapstructure:"name"`
+
+	//
+	Recipes []string `mapstructure:"recipes"`
+
+	//
+	NodeJSON string `mapstructure:"node_json"`
+
+	//
+	NodeYAML string `mapstructure:"node_yaml"`
+
+	//
+	Vars []string `mapstructure:"environment_vars"`
+
+	//
+	PreventSudo *bool `mapstructure:"prevent_sudo"`
+
+	//
+	IgnoreExitCodes *bool `mapstructure:"ignore_exit_codes"`
+
+	//
+	ValidExitCodes []int `mapstructure:"valid_exit_codes"`
+
+	//
+	FailOnChange *bool `mapstructure:"fail_on_change"`
+}
+
+//
+func (p *Provisioner) preparePhases() *packer.MultiError {
+	var errs *packer.MultiError
+
+	names := make(map[string]bool, len(p.config.Phases))
+	for idx := range p.config.Phases {
+		phase := &p.config.Phases[idx]
+		config := fmt.Sprintf("phases[%d]", idx)
+
+		if phase.Name == "" {
+			phase.Name = fmt.Sprintf("phase-%d", idx+1)
+		}
+
+		if names[phase.Name] {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("%s: phase name %q must be unique", config, phase.Name))
+		}
+		names[phase.Name] = true
+
+		if len(phase.Recipes) == 0 {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("%s: A list of recipes must be specified.", config))
+		}
+
+		recipes := make([]string, 0, len(phase.Recipes))
+		for i, recipe := range phase.Recipes {
+			paths, err := p.expandRecipe(recipe, fmt.Sprintf("%s.recipes[%d]", config, i))
+			if err != nil {
+				errs = packer.MultiErrorAppend(errs, err)
+				continue
+			}
+
+			for _, path := range paths {
+				if err := p.validateFileConfig(path, fmt.Sprintf("%s.recipes[%d]", config, i)); err != nil {
+					errs = packer.MultiErrorAppend(errs, err)
+				}
+			}
+			recipes = append(recipes, paths...)
+		}
+		phase.Recipes = recipes
+
+		if phase.NodeJSON != "" {
+			if err := p.validateFileConfig(phase.NodeJSON, config+".node_json"); err != nil {
+				errs = packer.MultiErrorAppend(errs, err)
+			}
+		}
+
+		if phase.NodeYAML != "" {
+			if err := p.validateFileConfig(phase.NodeYAML, config+".node_yaml"); err != nil {
+				errs = packer.MultiErrorAppend(errs, err)
+			}
+		}
+
+		for i, kv := range phase.Vars {
+			vs := strings.SplitN(kv, "=", 2)
+			if len(vs) != 2 || vs[0] == "" {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("%s: Environment variable not in format 'key=value': %s", config, kv))
+			} else {
+				vs[1] = strings.Replace(vs[1], "'", `'"'"'`, -1)
+				phase.Vars[i] = fmt.Sprintf("%s='%s'", vs[0], vs[1])
+			}
+		}
+	}
+	return errs
+}
+
+//
+func (p *Provisioner) executePhases(ui packer.Ui, comm packer.Communicator) error {
+	return p.collectJUnitReport(ui, func() error {
+		return p.executePhaseRecipes(ui, comm)
+	})
+}
+
+//
+func (p *Provisioner) executePhaseRecipes(ui packer.Ui, comm packer.Communicator) error {
+	for idx, phase := range p.config.Phases {
+		ui.Say(fmt.Sprintf("Phase %d of %d: %s", idx+1, len(p.config.Phases), phase.Name))
+		p.machine(ui, "phase", "start", phase.Name)
+
+		start := time.Now()
+		err := p.withPhase(phase, func() error {
+			return p.executeRecipes(ui, comm)
+		})
+		elapsed := time.Since(start).Round(time.Millisecond)
+
+		p.machine(ui, "phase", "end", phase.Name, machineResult(err))
+		if err != nil {
+			ui.Error(fmt.Sprintf("Phase %s failed after %s", phase.Name, elapsed))
+			return fmt.Errorf("Error executing phase %s: %s", phase.Name, err)
+		}
+		ui.Message(fmt.Sprintf("Phase %s completed in %s", phase.Name, elapsed))
+	}
+	return nil
+}
+
+//
+func (p *Provisioner) withPhase(phase Phase, f func() error) error {
+	config := p.config
+	defer func() {
+		p.config = config
+		p.phase = ""
+	}()
+
+	p.phase = phase.Name
+	p.config.Recipes = phase.Recipes
+
+	if phase.NodeJSON != "" {
+		p.config.NodeJSON = phase.NodeJSON
+	}
+
+	if phase.NodeYAML != "" {
+		p.config.NodeYAML = phase.NodeYAML
+	}
+
+	//
+	vars := make([]string, 0, len(config.Vars)+len(phase.Vars))
+	vars = append(vars, config.Vars...)
+	p.config.Vars = append(vars, phase.Vars...)
+
+	if phase.PreventSudo != nil {
+		p.config.PreventSudo = *phase.PreventSudo
+	}
+
+	if phase.IgnoreExitCodes != nil {
+		p.config.IgnoreExitCodes = *phase.IgnoreExitCodes
+	}
+
+	if phase.ValidExitCodes != nil {
+		p.config.ValidExitCodes = phase.ValidExitCodes
+	}
+
+	if phase.FailOnChange != nil {
+		p.config.FailOnChange = *phase.FailOnChange
+	}
+	return f()
+}
+
+//
+func (p *Provisioner) stagingRecipes() []string {
+	if len(p.config.Phases) == 0 {
+		return p.config.Recipes
+	}
+
+	seen := make(map[string]bool)
+
+	recipes := make([]string, 0)
+	for _, phase := range p.config.Phases {
+		for _, recipe := range phase.Recipes {
+			if seen[recipe] {
+				continue
+			}
+			seen[recipe] = true
+			recipes = append(recipes, recipe)
+		}
+	}
+	return recipes
+}
@@ -0,0 +1,190 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_Phases(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb":   "",
+		"app.rb":    "",
+		"node.json": "{}",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["phases"] = []map[string]interface{}{
+		{
+			"recipes":          []string{"base.rb"},
+			"environment_vars": []string{"FOO=it's"},
+		},
+		{
+			"name":         "app",
+			"recipes":      []string{"app.rb"},
+			"node_json":    "node.json",
+			"prevent_sudo": true,
+		},
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	if len(p.config.Phases) != 2 {
+		t.Fatalf("incorrect number of phases, given %d, want %d", len(p.config.Phases), 2)
+	}
+
+	if name := p.config.Phases[0].Name; name != "phase-1" {
+		t.Errorf("incorrect default phase name, given %q, want %q", name, "phase-1")
+	}
+
+	expected := `FOO='it'"'"'s'`
+	if vars := p.config.Phases[0].Vars; len(vars) != 1 || vars[0] != expected {
+		t.Errorf("incorrect environment_vars, given %v, want %v", vars, expected)
+	}
+
+	if sudo := p.config.Phases[1].PreventSudo; sudo == nil || !*sudo {
+		t.Errorf("incorrect prevent_sudo, given %v, want %t", sudo, true)
+	}
+
+	p = Provisioner{}
+
+	config["recipes"] = []string{"base.rb"}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if both phases and recipes are specified")
+	}
+
+	p = Provisioner{}
+	delete(config, "recipes")
+
+	config["phases"] = []map[string]interface{}{
+		{"name": "base"},
+	}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if a phase has no recipes")
+	}
+
+	p = Provisioner{}
+
+	config["phases"] = []map[string]interface{}{
+		{"name": "base", "recipes": []string{"base.rb"}},
+		{"name": "base", "recipes": []string{"app.rb"}},
+	}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if phase names are not unique")
+	}
+
+	p = Provisioner{}
+
+	config["phases"] = []map[string]interface{}{
+		{"recipes": []string{"base.rb"}, "environment_vars": []string{"=bad"}},
+	}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if a phase environment variable is invalid")
+	}
+}
+
+func TestProvisionerProvision_Phases(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb": "",
+		"app.rb":  "",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["environment_vars"] = []string{"SHARED=yes"}
+	config["phases"] = []map[string]interface{}{
+		{
+			"name":             "base",
+			"recipes":          []string{"base.rb"},
+			"environment_vars": []string{"PHASE=base"},
+		},
+		{
+			"name":             "app",
+			"recipes":          []string{"app.rb"},
+			"prevent_sudo":     true,
+			"valid_exit_codes": []int{0, 2, 3},
+		},
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "app.rb") {
+			return "", 3
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if attempts := testInstallAttempts(comm.Commands); attempts != 1 {
+		t.Errorf("incorrect number of install attempts, given %d, want %d", attempts, 1)
+	}
+
+	commands := testItamaeCommands(comm.Commands)
+	if len(commands) != 2 {
+		t.Fatalf("incorrect number of runs, given %d, want %d", len(commands), 2)
+	}
+
+	if !strings.Contains(commands[0], "SHARED='yes' PHASE='base' sudo -E") || !strings.Contains(commands[0], "base.rb") {
+		t.Errorf("incorrect command for phase base, got: %s", commands[0])
+	}
+
+	if strings.Contains(commands[1], "PHASE=") || strings.Contains(commands[1], "sudo -E") {
+		t.Errorf("incorrect command for phase app, got: %s", commands[1])
+	}
+
+	for _, header := range []string{"Phase 1 of 2: base", "Phase 2 of 2: app", "Phase app completed in"} {
+		if ok := strings.Contains(buffer.String(), header); !ok {
+			t.Errorf("should include %q, but got: %s", header, buffer)
+		}
+	}
+
+	if vars := p.config.Vars; len(vars) != 1 || vars[0] != "SHARED='yes'" {
+		t.Errorf("should restore environment_vars after phases, but got: %v", vars)
+	}
+
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "base.rb") {
+			return "", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error executing phase base") {
+		t.Errorf("should be an error naming the failed phase, but got: %v", err)
+	}
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 1 {
+		t.Errorf("should stop after the failed phase, but got %d runs", len(commands))
+	}
+}
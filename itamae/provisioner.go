@@ -1,11 +1,14 @@
 package itamaelocal
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,8 +35,35 @@ var (
 		"specinfra-ec2_metadata-tags",
 	}
 
+	//
+	DefaultValidExitCodes = []int{0, 2}
+
+	//
+	DefaultInstallValidExitCodes = []int{0}
+
 	//
 	DefaultRetrySleep = 5 * time.Second
+
+	//
+	DefaultRetryMaxDelay = 1 * time.Minute
+
+	//
+	DefaultPollInterval = 2 * time.Second
+
+	//
+	DefaultReconnectTimeout = 5 * time.Minute
+
+	//
+	DefaultRebootTimeout = 5 * time.Minute
+
+	//
+	DefaultRebootPollInterval = 5 * time.Second
+
+	//
+	DefaultMaxReboots = 3
+
+	//
+	DefaultTranscriptCloseTimeout = 5 * time.Second
 )
 
 //
@@ -55,12 +85,72 @@ type Config struct {
 	//
 	InstallRetryTimeout time.Duration `mapstructure:"install_retry_timeout"`
 
+	//
+	InstallMaxAttempts int `mapstructure:"install_max_attempts"`
+
+	//
+	InstallRetryDelay time.Duration `mapstructure:"install_retry_delay"`
+
+	//
+	InstallRetryMaxDelay time.Duration `mapstructure:"install_retry_max_delay"`
+
+	//
+	InstallAttemptTimeout time.Duration `mapstructure:"install_attempt_timeout"`
+
+	//
+	InstallTimeout time.Duration `mapstructure:"install_timeout"`
+
+	//
+	UploadTimeout time.Duration `mapstructure:"upload_timeout"`
+
+	//
+	ExecuteTimeout time.Duration `mapstructure:"execute_timeout"`
+
+	//
+	InstallRetryExitCodes []int `mapstructure:"install_retry_exit_codes"`
+
+	//
+	InstallRetryPatterns []string `mapstructure:"install_retry_patterns"`
+
 	//
 	SkipInstall bool `mapstructure:"skip_install"`
 
 	//
 	ExecuteCommand string `mapstructure:"execute_command"`
 
+	//
+	ExecuteDetached bool `mapstructure:"execute_detached"`
+
+	//
+	ExecutePollInterval time.Duration `mapstructure:"execute_poll_interval"`
+
+	//
+	ExecuteReconnectTimeout time.Duration `mapstructure:"execute_reconnect_timeout"`
+
+	//
+	ExecuteRetries int `mapstructure:"execute_retries"`
+
+	//
+	RebootOnRequest bool `mapstructure:"reboot_on_request"`
+
+	//
+	RebootCommand string `mapstructure:"reboot_command"`
+
+	//
+	RebootTimeout time.Duration `mapstructure:"reboot_timeout"`
+
+	//
+	MaxReboots int `mapstructure:"max_reboots"`
+
+	//
+	ExecuteRetryDelay time.Duration `mapstructure:"execute_retry_delay"`
+
+	//
+	ExecuteRetryExitCodes []int `mapstructure:"execute_retry_exit_codes"`
+
+	//
+	ExecuteRetryPatterns []string `mapstructure:"execute_retry_patterns"`
+
 	//
 	PreventSudo bool `mapstructure:"prevent_sudo"`
 
@@ -71,7 +161,28 @@ type Config struct {
 	CleanStagingDir bool `mapstructure:"clean_staging_directory"`
 
 	//
-	SourceDir string `mapstructure:"source_directory"`
+	SourceDirs []string `mapstructure:"source_directory"`
+
+	//
+	SourceDir string `mapstructure:"-"`
+
+	//
+	SourceGit *GitSource `mapstructure:"source_git"`
+
+	//
+	SourceArchive string `mapstructure:"source_archive"`
+
+	//
+	SourceArchiveChecksum string `mapstructure:"source_archive_checksum"`
+
+	//
+	SourceChecksums string `mapstructure:"source_checksums"`
+
+	//
+	SourceChecksumsSignature string `mapstructure:"source_checksums_signature"`
+
+	//
+	TrustedKeys []string `mapstructure:"trusted_keys"`
 
 	//
 	LogLevel string `mapstructure:"log_level"`
@@ -82,6 +193,9 @@ type Config struct {
 	//
 	NodeJSON string `mapstructure:"node_json"`
 
+	//
+	RemoteNodeJSON string `mapstructure:"remote_node_json"`
+
 	//
 	NodeYAML string `mapstructure:"node_yaml"`
 
@@ -97,16 +211,97 @@ type Config struct {
 	//
 	Recipes []string `mapstructure:"recipes"`
 
+	//
+	RemoteRecipes []string `mapstructure:"remote_recipes"`
+
+	//
+	InlineRecipe interface{} `mapstructure:"inline_recipe"`
+
+	//
+	RunList []string `mapstructure:"run_list"`
+
+	//
+	Phases []Phase `mapstructure:"phases"`
+
+	//
+	CookbooksPath string `mapstructure:"cookbooks_path"`
+
+	//
+	RolesPath string `mapstructure:"roles_path"`
+
 	//
 	IgnoreExitCodes bool `mapstructure:"ignore_exit_codes"`
 
-	ctx interpolate.Context
+	//
+	ReportEvents bool `mapstructure:"report_events"`
+
+	//
+	ReportJUnit string `mapstructure:"report_junit"`
+
+	//
+	LogFile string `mapstructure:"log_file"`
+
+	//
+	LogRedact []string `mapstructure:"log_redact"`
+
+	//
+	DryRunFirst bool `mapstructure:"dry_run_first"`
+
+	//
+	DryRunOnly bool `mapstructure:"dry_run_only"`
+
+	//
+	VerifyIdempotency bool `mapstructure:"verify_idempotency"`
+
+	//
+	VerifyIdempotencyDryRun bool `mapstructure:"verify_idempotency_dry_run"`
+
+	//
+	ValidExitCodes []int `mapstructure:"valid_exit_codes"`
+
+	//
+	InstallValidExitCodes []int `mapstructure:"install_valid_exit_codes"`
+
+	//
+	FailOnChange bool `mapstructure:"fail_on_change"`
+
+	//
+	IsolateRecipes bool `mapstructure:"isolate_recipes"`
+
+	//
+	ContinueOnError bool `mapstructure:"continue_on_error"`
+
+	//
+	Resume bool `mapstructure:"resume"`
+
+	//
+	StateFile string `mapstructure:"state_file"`
+
+	//
+	Force bool `mapstructure:"force"`
+
+	//
+	SkipIf string `mapstructure:"skip_if"`
+
+	//
+	OnlyIf string `mapstructure:"only_if"`
+
+	ctx                  interpolate.Context
+	inlineRecipe         []string
+	eventsConfig         string
+	installRetryPatterns []*regexp.Regexp
+	executeRetryPatterns []*regexp.Regexp
 }
 
 //
 type Provisioner struct {
-	config        Config
-	guestCommands *provisioner.GuestCommands
+	config         Config
+	guestCommands  *provisioner.GuestCommands
+	sourceCommit   string
+	tempDirs       []string
+	isolatedRecipe string
+	phase          string
+	junitSuite     *junitTestSuite
 }
 
 //
@@ -124,6 +319,16 @@ type ExecuteTemplate struct {
 	ConfigFile     string
 	ExtraArguments string
 	Recipes        string
+	DryRun         bool
+}
+
+//
+type itamaeRun struct {
+	status   int
+	output   string
+	start    time.Time
+	duration time.Duration
+	events   []itamaeEvent
 }
 
 //
@@ -183,11 +388,47 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		p.config.InstallRetryTimeout = 5 * time.Minute
 	}
 
+	if p.config.InstallRetryDelay == 0 {
+		p.config.InstallRetryDelay = DefaultRetrySleep
+	}
+
+	if p.config.InstallRetryMaxDelay == 0 {
+		p.config.InstallRetryMaxDelay = DefaultRetryMaxDelay
+	}
+
+	if p.config.ExecuteRetryDelay == 0 {
+		p.config.ExecuteRetryDelay = DefaultRetrySleep
+	}
+
+	if p.config.ExecutePollInterval == 0 {
+		p.config.ExecutePollInterval = DefaultPollInterval
+	}
+
+	if p.config.ExecuteReconnectTimeout == 0 {
+		p.config.ExecuteReconnectTimeout = DefaultReconnectTimeout
+	}
+
+	if p.config.RebootCommand == "" {
+		p.config.RebootCommand = "shutdown -r now"
+		if !p.config.PreventSudo {
+			p.config.RebootCommand = "sudo " + p.config.RebootCommand
+		}
+	}
+
+	if p.config.RebootTimeout == 0 {
+		p.config.RebootTimeout = DefaultRebootTimeout
+	}
+
+	if p.config.MaxReboots == 0 {
+		p.config.MaxReboots = DefaultMaxReboots
+	}
+
 	//
 	if p.config.ExecuteCommand == "" {
 		p.config.ExecuteCommand = "cd {{.StagingDir}} && " +
 			"{{.Vars}} {{if .Sudo}}sudo -E {{end}}" +
 			"{{.Command}} local --detailed-exitcode " +
+			"{{if .DryRun}}--dry-run {{end}}" +
 			"{{if .Color}}--color='{{printf \"%t\" .ColorValue}}' {{end}}" +
 			"{{if ne .LogLevel \"\"}}--log-level='{{.LogLevel}}' {{end}}" +
 			"{{if ne .Shell \"\"}}--shell='{{.Shell}}' {{end}}" +
@@ -202,12 +443,63 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		p.config.ExtraArguments = make([]string, 0)
 	}
 
+	if p.config.ValidExitCodes == nil {
+		p.config.ValidExitCodes = DefaultValidExitCodes
+	}
+
+	if p.config.InstallValidExitCodes == nil {
+		p.config.InstallValidExitCodes = DefaultInstallValidExitCodes
+	}
+
+	if p.config.CookbooksPath == "" {
+		p.config.CookbooksPath = DefaultCookbooksPath
+	}
+
+	if p.config.RolesPath == "" {
+		p.config.RolesPath = DefaultRolesPath
+	}
+
 	if p.config.StagingDir == "" {
 		p.config.StagingDir = filepath.ToSlash(filepath.Join(DefaultStagingDir, uuid.TimeOrderedUUID()))
 	}
 
 	var errs *packer.MultiError
 
+	if p.config.ContinueOnError && !p.config.IsolateRecipes {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("continue_on_error requires isolate_recipes to be set."))
+	}
+
+	if p.config.Resume && !p.config.IsolateRecipes {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("resume requires isolate_recipes to be set."))
+	}
+
+	if p.config.RebootOnRequest && !p.config.IsolateRecipes {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("reboot_on_request requires isolate_recipes to be set."))
+	}
+
+	if p.config.InstallMaxAttempts < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("install_max_attempts: %d must not be negative", p.config.InstallMaxAttempts))
+	}
+
+	p.config.installRetryPatterns, err = compileRetryPatterns(p.config.InstallRetryPatterns, "install_retry_patterns")
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	if p.config.ExecuteRetries < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("execute_retries: %d must not be negative", p.config.ExecuteRetries))
+	}
+
+	p.config.executeRetryPatterns, err = compileRetryPatterns(p.config.ExecuteRetryPatterns, "execute_retry_patterns")
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
 	for idx, kv := range p.config.Vars {
 		vs := strings.SplitN(kv, "=", 2)
 		if len(vs) != 2 || vs[0] == "" {
@@ -219,18 +511,79 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	if (len(p.config.SourceDirs) > 0 && p.config.SourceGit != nil) ||
+		(len(p.config.SourceDirs) > 0 && p.config.SourceArchive != "") ||
+		(p.config.SourceGit != nil && p.config.SourceArchive != "") {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Only one of source_directory, source_git or source_archive can be specified."))
+	} else if p.config.SourceGit != nil || p.config.SourceArchive != "" {
+		if err := p.prepareSource(); err != nil {
+			p.removeTempDirs()
+			return packer.MultiErrorAppend(errs, err)
+		}
+	} else if len(p.config.SourceDirs) == 1 {
+		p.config.SourceDir = p.config.SourceDirs[0]
+	} else if len(p.config.SourceDirs) > 1 {
+		for idx, dir := range p.config.SourceDirs {
+			if err := p.validateDirConfig(dir, fmt.Sprintf("source_directory[%d]", idx)); err != nil {
+				errs = packer.MultiErrorAppend(errs, err)
+			}
+		}
+
+		if errs != nil && len(errs.Errors) > 0 {
+			return errs
+		}
+
+		if err := p.prepareSource(); err != nil {
+			p.removeTempDirs()
+			return packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	if p.config.DryRunOnly && p.config.VerifyIdempotency {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Only one of dry_run_only or verify_idempotency can be specified."))
+	}
+
+	if p.config.SourceArchiveChecksum != "" && p.config.SourceArchive == "" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("source_archive_checksum requires source_archive to be specified."))
+	}
+
 	if p.config.SourceDir != "" {
 		if err := p.validateDirConfig(p.config.SourceDir, "source_directory"); err != nil {
 			errs = packer.MultiErrorAppend(errs, err)
 		}
 	}
 
+	if p.config.SourceChecksums != "" {
+		if err := p.validateChecksumsConfig(); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		} else if err := p.verifySourceChecksums(); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	} else if p.config.SourceChecksumsSignature != "" || len(p.config.TrustedKeys) > 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("source_checksums_signature and trusted_keys require source_checksums to be specified."))
+	}
+
 	if p.config.NodeJSON != "" {
 		if err := p.validateFileConfig(p.config.NodeJSON, "node_json"); err != nil {
 			errs = packer.MultiErrorAppend(errs, err)
 		}
 	}
 
+	if p.config.RemoteNodeJSON != "" {
+		if p.config.NodeJSON != "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Only one of node_json or remote_node_json can be specified."))
+		}
+
+		if err := p.validateRemotePathConfig(p.config.RemoteNodeJSON, "remote_node_json"); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
 	if p.config.NodeYAML != "" {
 		if err := p.validateFileConfig(p.config.NodeYAML, "node_yaml"); err != nil {
 			errs = packer.MultiErrorAppend(errs, err)
@@ -240,24 +593,99 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 	if p.config.ConfigFile != "" {
 		if err := p.validateFileConfig(p.config.ConfigFile, "config_file"); err != nil {
 			errs = packer.MultiErrorAppend(errs, err)
+		} else if p.collectsEvents() {
+			if err := p.prepareEventsConfig(); err != nil {
+				errs = packer.MultiErrorAppend(errs, err)
+			}
 		}
 	}
 
-	if p.config.Recipes == nil {
+	if p.config.ReportJUnit != "" {
+		if err := validateReportPathConfig(p.config.ReportJUnit, "report_junit"); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	if p.config.LogFile != "" {
+		if err := validateReportPathConfig(p.config.LogFile, "log_file"); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	if p.config.StateFile != "" {
+		if err := p.validateRemotePathConfig(p.config.StateFile, "state_file"); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	} else if p.config.Force {
 		errs = packer.MultiErrorAppend(errs,
-			fmt.Errorf("A list of recipes must be specified."))
-	} else if len(p.config.Recipes) == 0 {
+			fmt.Errorf("force requires state_file to be specified."))
+	}
+
+	for idx, path := range p.config.RemoteRecipes {
+		if err := p.validateRemotePathConfig(path, fmt.Sprintf("remote_recipes[%d]", idx)); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	p.config.inlineRecipe, err = decodeInlineRecipe(p.config.InlineRecipe)
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	if len(p.config.Phases) > 0 {
+		if len(p.config.Recipes) > 0 || len(p.config.RunList) > 0 ||
+			len(p.config.RemoteRecipes) > 0 || p.config.InlineRecipe != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Only one of phases or recipes, run_list, remote_recipes or inline_recipe can be specified."))
+		}
+
+		if perrs := p.preparePhases(); perrs != nil {
+			errs = packer.MultiErrorAppend(errs, perrs.Errors...)
+		}
+	} else if p.config.Recipes == nil && p.config.RunList == nil &&
+		p.config.RemoteRecipes == nil && p.config.InlineRecipe == nil {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("A list of recipes or a run list must be specified."))
+	} else if len(p.config.Recipes) == 0 && len(p.config.RunList) == 0 &&
+		len(p.config.RemoteRecipes) == 0 && p.config.InlineRecipe == nil {
 		errs = packer.MultiErrorAppend(errs,
-			fmt.Errorf("A list of recipes cannot be empty."))
+			fmt.Errorf("A list of recipes or a run list cannot be empty."))
 	} else {
-		for idx, path := range p.config.Recipes {
-			if err := p.validateFileConfig(path, fmt.Sprintf("recipes[%d]", idx)); err != nil {
+		recipes := make([]string, 0, len(p.config.Recipes))
+		for idx, recipe := range p.config.Recipes {
+			paths, err := p.expandRecipe(recipe, fmt.Sprintf("recipes[%d]", idx))
+			if err != nil {
+				errs = packer.MultiErrorAppend(errs, err)
+				continue
+			}
+
+			for _, path := range paths {
+				if err := p.validateFileConfig(path, fmt.Sprintf("recipes[%d]", idx)); err != nil {
+					errs = packer.MultiErrorAppend(errs, err)
+				}
+			}
+			recipes = append(recipes, paths...)
+		}
+
+		for idx, entry := range p.config.RunList {
+			paths, err := p.resolveRunList(entry, fmt.Sprintf("run_list[%d]", idx))
+			if err != nil {
 				errs = packer.MultiErrorAppend(errs, err)
+				continue
 			}
+
+			for _, path := range paths {
+				if err := p.validateFileConfig(path, fmt.Sprintf("run_list[%d]", idx)); err != nil {
+					errs = packer.MultiErrorAppend(errs, err)
+				}
+			}
+			recipes = append(recipes, paths...)
 		}
+		p.config.Recipes = recipes
 	}
 
 	if errs != nil && len(errs.Errors) > 0 {
+		p.removeTempDirs()
 		return errs
 	}
 	return nil
@@ -265,13 +693,126 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 
 //
 func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
+	//
+	defer p.removeTempDirs()
+
+	return p.provision(ui, comm)
+}
+
+//
+func (p *Provisioner) provision(ui packer.Ui, comm packer.Communicator) error {
 	ui.Say("Provisioning with Itamae...")
 
+	if p.config.LogFile != "" {
+		t, err := newTranscript(p.config.LogFile, p.transcriptRedactions())
+		if err != nil {
+			return fmt.Errorf("Error opening log file: %s", err)
+		}
+		defer func() {
+			if err := t.Close(); err != nil {
+				log.Printf("Unable to close log file %s: %s", p.config.LogFile, err)
+			}
+		}()
+
+		comm = &transcriptCommunicator{
+			Communicator: comm,
+			transcript:   t,
+		}
+	}
+
+	if skip, err := p.skipProvisioning(ui, comm); err != nil {
+		return fmt.Errorf("Error evaluating guard: %s", err)
+	} else if skip {
+		return nil
+	}
+
+	if p.remoteSource() && len(p.tempDirs) == 0 {
+		ui.Message("Preparing source directory...")
+		if err := p.prepareSource(); err != nil {
+			return fmt.Errorf("Error preparing source directory: %s", err)
+		}
+
+		if p.config.SourceChecksums != "" {
+			if err := p.verifySourceChecksums(); err != nil {
+				return fmt.Errorf("Error verifying source directory: %s", err)
+			}
+		}
+	}
+
+	if p.sourceCommit != "" {
+		ui.Message(fmt.Sprintf("Using source from %s at commit %s",
+			p.config.SourceGit.URL, p.sourceCommit))
+	}
+
+	var state string
+	if p.config.StateFile != "" {
+		//
+		gems, err := p.installedGems(comm)
+		if err != nil && p.config.SkipInstall {
+			return fmt.Errorf("Error listing installed gems: %s", err)
+		} else if err != nil {
+			ui.Error(fmt.Sprintf("Unable to list installed gems, assuming none are installed: %s", err))
+		}
+
+		if state, err = p.desiredState(gems); err != nil {
+			return fmt.Errorf("Error computing desired state: %s", err)
+		}
+
+		current, err := p.readState(comm)
+		if err != nil {
+			return fmt.Errorf("Error reading state file: %s", err)
+		}
+
+		if current == state && !p.config.Force {
+			ui.Message(fmt.Sprintf("Guest is already at the desired state %s, skipping provisioning...", state))
+			p.machine(ui, "state", "unchanged", state)
+			return nil
+		}
+
+		if current == state {
+			ui.Message(fmt.Sprintf("Guest is already at the desired state %s, but force is set...", state))
+		} else {
+			ui.Message(fmt.Sprintf("Guest state differs from the desired state %s...", state))
+		}
+	}
+
 	if !p.config.SkipInstall {
-		err := p.retryFunc(p.config.InstallRetryTimeout, func() error {
-			return p.installItamae(ui, comm)
+		start := time.Now()
+		err := p.retryWithPolicy(ui, p.installRetryPolicy(), func(attempt int) error {
+			timeout := p.config.InstallAttemptTimeout
+			if p.config.InstallTimeout > 0 {
+				remaining := p.config.InstallTimeout - time.Since(start)
+				if remaining <= 0 {
+					return &timeoutError{
+						phase:   "install",
+						elapsed: time.Since(start).Round(time.Millisecond),
+						final:   true,
+					}
+				}
+
+				if timeout == 0 || remaining < timeout {
+					timeout = remaining
+				}
+			}
+
+			if attempt > 1 {
+				p.machine(ui, "install", "retry", strconv.Itoa(attempt))
+			}
+
+			p.machine(ui, "install", "start", strconv.Itoa(attempt))
+			err := p.installItamae(ui, comm, timeout)
+			p.machine(ui, "install", "end", strconv.Itoa(attempt), machineResult(err))
+
+			//
+			if terr, ok := err.(*timeoutError); ok && p.config.InstallTimeout > 0 &&
+				time.Since(start) >= p.config.InstallTimeout {
+				terr.elapsed = time.Since(start).Round(time.Millisecond)
+				terr.final = true
+			}
+			return err
 		})
 		if err != nil {
+			p.cleanupAfterTimeout(ui, comm, err)
 			return fmt.Errorf("Error installing Itamae: %s", err)
 		}
 	}
@@ -280,40 +821,146 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 	if err := p.createDir(ui, comm, p.config.StagingDir); err != nil {
 		return fmt.Errorf("Error creating staging directory: %s", err)
 	}
+	p.machine(ui, "staging", "create", p.config.StagingDir)
 
-	if p.config.SourceDir != "" {
-		ui.Message("Uploading source directory to staging directory...")
-		if err := p.uploadDir(ui, comm, p.config.StagingDir, p.config.SourceDir); err != nil {
-			return fmt.Errorf("Error uploading source directory: %s", err)
+	err := p.withTimeout("upload", p.config.UploadTimeout, func() error {
+		return p.uploadStagingFiles(ui, comm)
+	})
+	if err != nil {
+		if _, ok := err.(*timeoutError); ok {
+			p.cleanupAfterTimeout(ui, comm, err)
+			return fmt.Errorf("Error uploading to staging directory: %s", err)
 		}
-	} else {
-		ui.Message("Uploading recipes...")
-		for _, src := range p.config.Recipes {
-			dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, src))
-			if err := p.uploadFile(ui, comm, dst, src); err != nil {
-				return fmt.Errorf("Error uploading recipe: %s", err)
-			}
+		return err
+	}
+
+	if p.config.RemoteNodeJSON != "" || len(p.config.RemoteRecipes) > 0 {
+		ui.Message("Checking remote recipes...")
+		if err := p.checkRemoteFiles(ui, comm); err != nil {
+			return fmt.Errorf("Error checking remote recipes: %s", err)
 		}
 	}
 
-	if err := p.executeItamae(ui, comm); err != nil {
-		return fmt.Errorf("Error executing Itamae: %s", err)
+	if len(p.config.Phases) > 0 {
+		if err := p.executePhases(ui, comm); err != nil {
+			return err
+		}
+	} else if err := p.executeRecipes(ui, comm); err != nil {
+		return err
+	}
+
+	if p.config.StateFile != "" && !p.config.DryRunOnly {
+		//
+		gems, err := p.installedGems(comm)
+		if err != nil {
+			return fmt.Errorf("Error listing installed gems: %s", err)
+		}
+
+		if state, err = p.desiredState(gems); err != nil {
+			return fmt.Errorf("Error computing desired state: %s", err)
+		}
+
+		ui.Message(fmt.Sprintf("Updating state file: %s", p.config.StateFile))
+		if err := p.writeState(ui, comm, state); err != nil {
+			return fmt.Errorf("Error updating state file: %s", err)
+		}
+		p.machine(ui, "state", "update", state)
 	}
 
 	if p.config.CleanStagingDir {
 		ui.Message("Removing staging directory...")
+		p.machine(ui, "cleanup", "start", p.config.StagingDir)
 		if err := p.removeDir(ui, comm, p.config.StagingDir); err != nil {
 			return fmt.Errorf("Error removing staging directory: %s", err)
 		}
+		p.machine(ui, "cleanup", "end", p.config.StagingDir)
+	}
+	return nil
+}
+
+//
+func (p *Provisioner) executeRecipes(ui packer.Ui, comm packer.Communicator) error {
+	ui.Message("Recipes will be executed in the following order:")
+	for idx, recipe := range p.recipes() {
+		ui.Message(fmt.Sprintf("%d. %s", idx+1, recipe))
+	}
+
+	if p.config.DryRunFirst && !p.config.DryRunOnly {
+		if err := p.dryRunItamae(ui, comm); err != nil {
+			p.cleanupAfterTimeout(ui, comm, err)
+			return fmt.Errorf("Error executing Itamae dry run: %s", err)
+		}
+	}
+
+	if err := p.executeItamae(ui, comm, p.config.DryRunOnly); err != nil {
+		p.cleanupAfterTimeout(ui, comm, err)
+		return fmt.Errorf("Error executing Itamae: %s", err)
+	}
+
+	if p.config.VerifyIdempotency {
+		if err := p.verifyIdempotency(ui, comm); err != nil {
+			p.cleanupAfterTimeout(ui, comm, err)
+			return fmt.Errorf("Error verifying idempotency: %s", err)
+		}
 	}
 	return nil
 }
 
 //
 func (p *Provisioner) Cancel() {
+	p.removeTempDirs()
 	os.Exit(0)
 }
 
+//
+func (p *Provisioner) remoteSource() bool {
+	return p.config.SourceGit != nil || p.config.SourceArchive != "" || len(p.config.SourceDirs) > 1
+}
+
+//
+func (p *Provisioner) prepareSource() error {
+	switch {
+	case p.config.SourceGit != nil:
+		//
+		source := p.config.SourceGit
+		if p.sourceCommit != "" {
+			pinned := *source
+			pinned.Ref = p.sourceCommit
+			source = &pinned
+		}
+
+		dir, commit, err := p.fetchGitSource(source)
+		if err != nil {
+			return err
+		}
+		p.config.SourceDir = dir
+		p.sourceCommit = commit
+	case p.config.SourceArchive != "":
+		dir, err := p.unpackSourceArchive(p.config.SourceArchive, p.config.SourceArchiveChecksum)
+		if err != nil {
+			return err
+		}
+		p.config.SourceDir = dir
+	case len(p.config.SourceDirs) > 1:
+		dir, err := p.mergeSourceDirs(p.config.SourceDirs)
+		if err != nil {
+			return err
+		}
+		p.config.SourceDir = dir
+	}
+	return nil
+}
+
+//
+func (p *Provisioner) removeTempDirs() {
+	for _, dir := range p.tempDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Unable to remove temporary directory %s: %s", dir, err)
+		}
+	}
+	p.tempDirs = nil
+}
+
 //
 func (p *Provisioner) guestOStype() string {
 	unixes := map[string]bool{
@@ -337,24 +984,6 @@ func (p *Provisioner) prefixPath(path, prefix string) string {
 	return filepath.ToSlash(path)
 }
 
-//
-func (p *Provisioner) retryFunc(timeout time.Duration, f func() error) error {
-	finish := time.After(timeout)
-	for {
-		err := f()
-		if err == nil {
-			return nil
-		}
-		log.Printf("Retrying due to error: %v", err)
-
-		select {
-		case <-finish:
-			return err
-		case <-time.After(DefaultRetrySleep):
-		}
-	}
-}
-
 //
 func (p *Provisioner) validateDirConfig(path, config string) error {
 	fi, err := os.Stat(path)
@@ -368,6 +997,14 @@ func (p *Provisioner) validateDirConfig(path, config string) error {
 	return nil
 }
 
+//
+func (p *Provisioner) validateRemotePathConfig(path, config string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%s: %s must be an absolute path", config, path)
+	}
+	return nil
+}
+
 //
 func (p *Provisioner) validateFileConfig(path, config string) error {
 	path = p.prefixPath(path, p.config.SourceDir)
@@ -384,7 +1021,7 @@ func (p *Provisioner) validateFileConfig(path, config string) error {
 }
 
 //
-func (p *Provisioner) installItamae(ui packer.Ui, comm packer.Communicator) error {
+func (p *Provisioner) installItamae(ui packer.Ui, comm packer.Communicator, timeout time.Duration) error {
 	ui.Message("Installing Itamae...")
 
 	p.config.ctx.Data = &InstallTemplate{
@@ -397,37 +1034,151 @@ func (p *Provisioner) installItamae(ui packer.Ui, comm packer.Communicator) erro
 		return err
 	}
 
+	var stdout, stderr bytes.Buffer
+
 	cmd := &packer.RemoteCmd{
 		Command: command,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
 	}
 
 	ui.Message(fmt.Sprintf("Executing: %s", command))
-	if err := cmd.StartWithUi(comm, ui); err != nil {
+	if err := p.startWithTimeout(ui, comm, cmd, "install", timeout); err != nil {
 		return err
 	}
 
-	if cmd.ExitStatus != 0 {
-		return fmt.Errorf("Non-zero exit status. See output above for more information.")
+	if err := p.validateExitStatus(cmd.ExitStatus, p.config.InstallValidExitCodes); err != nil {
+		return &commandError{
+			status: cmd.ExitStatus,
+			output: stdout.String() + stderr.String(),
+			err:    err,
+		}
 	}
 	return nil
 }
 
 //
-func (p *Provisioner) executeItamae(ui packer.Ui, comm packer.Communicator) error {
-	ui.Message("Executing Itamae...")
+func (p *Provisioner) executeItamae(ui packer.Ui, comm packer.Communicator, dryRun bool) error {
+	if p.config.IsolateRecipes && p.isolatedRecipe == "" {
+		return p.executeIsolated(ui, comm, dryRun)
+	}
+
+	_, err := p.executeItamaeRun(ui, comm, dryRun)
+	return err
+}
+
+//
+func (p *Provisioner) executeItamaeRun(ui packer.Ui, comm packer.Communicator, dryRun bool) (*itamaeRun, error) {
+	if dryRun {
+		ui.Message("Executing Itamae in dry run mode, no changes will be applied...")
+	} else {
+		ui.Message("Executing Itamae...")
+	}
+
+	var run *itamaeRun
+
+	execute := func(attempt int) (err error) {
+		if attempt > 1 {
+			ui.Message(fmt.Sprintf("Executing Itamae, attempt %d of %d...",
+				attempt, p.config.ExecuteRetries+1))
+		}
+
+		run, err = p.runItamae(ui, comm, dryRun)
+		if err != nil || p.config.IgnoreExitCodes {
+			return err
+		}
+
+		if err := p.validateExitStatus(run.status, p.config.ValidExitCodes); err != nil {
+			return &commandError{
+				status: run.status,
+				output: run.output,
+				err:    err,
+			}
+		}
+		return nil
+	}
 
+	var err error
+	if p.config.ExecuteRetries > 0 {
+		err = p.retryWithPolicy(ui, p.executeRetryPolicy(), execute)
+	} else {
+		err = execute(1)
+	}
+
+	if run == nil {
+		if p.config.ReportJUnit != "" {
+			p.writeJUnitReport(ui, nil, err)
+		}
+		return nil, err
+	}
+
+	if p.config.ReportEvents {
+		p.reportEvents(ui, run.events)
+	}
+
+	if dryRun {
+		p.reportPlannedChanges(ui, run.output)
+	}
+
+	if !p.config.IgnoreExitCodes {
+		err = p.validateExitStatus(run.status, p.config.ValidExitCodes)
+		if err == nil && p.config.FailOnChange && run.status == 2 {
+			err = fmt.Errorf("Exit status 2, resources were changed while fail_on_change is set. " +
+				"See output above for more information.")
+		}
+
+		if err != nil && p.config.inlineRecipe != nil {
+			for _, message := range p.inlineRecipeErrors(run.output) {
+				ui.Error(message)
+			}
+		}
+	}
+
+	if p.config.ReportJUnit != "" {
+		if rerr := p.writeJUnitReport(ui, run, err); rerr != nil && err == nil {
+			return run, rerr
+		}
+	}
+	return run, err
+}
+
+//
+func (p *Provisioner) runItamae(ui packer.Ui, comm packer.Communicator, dryRun bool) (*itamaeRun, error) {
 	//
-	envVars := make([]string, len(p.config.Vars)+2)
+	envVars := make([]string, 2, len(p.config.Vars)+5)
 	envVars[0] = fmt.Sprintf("PACKER_BUILD_NAME='%s'", p.config.PackerBuildName)
 	envVars[1] = fmt.Sprintf("PACKER_BUILDER_TYPE='%s'", p.config.PackerBuilderType)
 
 	//
 	httpAddr := common.GetHTTPAddr()
 	if httpAddr != "" {
-		envVars[3] = fmt.Sprintf("PACKER_HTTP_ADDR='%s'", httpAddr)
+		envVars = append(envVars, fmt.Sprintf("PACKER_HTTP_ADDR='%s'", httpAddr))
 	}
 
-	copy(envVars[2:], p.config.Vars)
+	if p.sourceCommit != "" {
+		envVars = append(envVars, fmt.Sprintf("PACKER_SOURCE_GIT_COMMIT='%s'", p.sourceCommit))
+	}
+
+	if p.config.RebootOnRequest {
+		envVars = append(envVars, fmt.Sprintf("PACKER_REBOOT_MARKER='%s'", p.rebootMarkerPath()))
+	}
+
+	envVars = append(envVars, p.config.Vars...)
+
+	nodeJSON := p.config.NodeJSON
+	if p.config.RemoteNodeJSON != "" {
+		nodeJSON = p.config.RemoteNodeJSON
+	}
+
+	configFile := p.config.ConfigFile
+	if p.collectsEvents() {
+		configFile = p.eventsConfigPath()
+	}
+
+	recipes := p.recipes()
+	if p.isolatedRecipe != "" {
+		recipes = []string{p.isolatedRecipe}
+	}
 
 	var color, colorValue bool
 
@@ -444,32 +1195,110 @@ func (p *Provisioner) executeItamae(ui packer.Ui, comm packer.Communicator) erro
 		StagingDir:     p.config.StagingDir,
 		LogLevel:       p.config.LogLevel,
 		Shell:          p.config.Shell,
-		NodeJSON:       p.config.NodeJSON,
+		NodeJSON:       nodeJSON,
 		NodeYAML:       p.config.NodeYAML,
 		Color:          color,
 		ColorValue:     colorValue,
-		ConfigFile:     p.config.ConfigFile,
+		ConfigFile:     configFile,
 		ExtraArguments: strings.Join(p.config.ExtraArguments, " "),
-		Recipes:        strings.Join(p.config.Recipes, " "),
+		Recipes:        strings.Join(recipes, " "),
+		DryRun:         dryRun,
 	}
 
 	command, err := interpolate.Render(p.config.ExecuteCommand, &p.config.ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	cmd := &packer.RemoteCmd{
-		Command: command,
-	}
+	start := time.Now()
+
+	p.machine(ui, "execute", "start", strconv.FormatBool(dryRun))
 
 	ui.Message(fmt.Sprintf("Executing: %s", command))
-	if err := cmd.StartWithUi(comm, ui); err != nil {
-		return err
+
+	run := &itamaeRun{
+		start: start,
 	}
 
-	if !p.config.IgnoreExitCodes {
-		if cmd.ExitStatus != 0 && cmd.ExitStatus != 2 {
-			return fmt.Errorf("Non-zero exit status. See output above for more information.")
+	if p.config.ExecuteDetached {
+		run.status, run.output, err = p.executeDetached(ui, comm, command)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var stdout, stderr bytes.Buffer
+
+		cmd := &packer.RemoteCmd{
+			Command: command,
+			Stdout:  &stdout,
+			Stderr:  &stderr,
+		}
+
+		if err := p.startWithTimeout(ui, comm, cmd, "execute", p.config.ExecuteTimeout); err != nil {
+			return nil, err
+		}
+		run.status, run.output = cmd.ExitStatus, stdout.String()+stderr.String()
+	}
+
+	run.duration = time.Since(start)
+	p.machineExecuteEnd(ui, run)
+
+	if p.collectsEvents() {
+		run.events = p.collectEvents(ui, comm)
+	}
+	return run, nil
+}
+
+//
+func (p *Provisioner) validateExitStatus(status int, valid []int) error {
+	codes := make([]string, len(valid))
+	for idx, code := range valid {
+		if status == code {
+			return nil
+		}
+		codes[idx] = strconv.Itoa(code)
+	}
+	return fmt.Errorf("Exit status %d is not one of the valid exit codes (%s). "+
+		"See output above for more information.", status, strings.Join(codes, ", "))
+}
+
+//
+func (p *Provisioner) recipes() []string {
+	recipes := make([]string, 0, len(p.config.Recipes)+len(p.config.RemoteRecipes)+1)
+	recipes = append(recipes, p.config.Recipes...)
+	recipes = append(recipes, p.config.RemoteRecipes...)
+
+	if p.config.inlineRecipe != nil {
+		recipes = append(recipes, DefaultInlineRecipeName)
+	}
+	return recipes
+}
+
+//
+func (p *Provisioner) checkRemoteFiles(ui packer.Ui, comm packer.Communicator) error {
+	paths := make([]string, 0, len(p.config.RemoteRecipes)+1)
+	if p.config.RemoteNodeJSON != "" {
+		paths = append(paths, p.config.RemoteNodeJSON)
+	}
+	paths = append(paths, p.config.RemoteRecipes...)
+
+	for _, path := range paths {
+		command := fmt.Sprintf("test -f '%s'", path)
+		if !p.config.PreventSudo {
+			command = "sudo " + command
+		}
+
+		cmd := &packer.RemoteCmd{
+			Command: command,
+		}
+
+		ui.Message(fmt.Sprintf("Checking file: %s", path))
+		if err := cmd.StartWithUi(comm, ui); err != nil {
+			return err
+		}
+
+		if cmd.ExitStatus != 0 {
+			return fmt.Errorf("File %s does not exist on the guest.", path)
 		}
 	}
 	return nil
@@ -487,7 +1316,7 @@ func (p *Provisioner) createDir(ui packer.Ui, comm packer.Communicator, dir stri
 	}
 
 	if cmd.ExitStatus != 0 {
-		return fmt.Errorf("Non-zero exit status. See output above for more information.")
+		return fmt.Errorf("Non-zero exit status %d. See output above for more information.", cmd.ExitStatus)
 	}
 
 	cmd = &packer.RemoteCmd{
@@ -498,7 +1327,7 @@ func (p *Provisioner) createDir(ui packer.Ui, comm packer.Communicator, dir stri
 	}
 
 	if cmd.ExitStatus != 0 {
-		return fmt.Errorf("Non-zero exit status. See output above for more information.")
+		return fmt.Errorf("Non-zero exit status %d. See output above for more information.", cmd.ExitStatus)
 	}
 	return nil
 }
@@ -515,7 +1344,38 @@ func (p *Provisioner) removeDir(ui packer.Ui, comm packer.Communicator, dir stri
 	}
 
 	if cmd.ExitStatus != 0 {
-		return fmt.Errorf("Non-zero exit status. See output above for more information.")
+		return fmt.Errorf("Non-zero exit status %d. See output above for more information.", cmd.ExitStatus)
+	}
+	return nil
+}
+
+//
+func (p *Provisioner) uploadStagingFiles(ui packer.Ui, comm packer.Communicator) error {
+	if p.config.SourceDir != "" {
+		ui.Message("Uploading source directory to staging directory...")
+		if err := p.uploadDir(ui, comm, p.config.StagingDir, p.config.SourceDir); err != nil {
+			return fmt.Errorf("Error uploading source directory: %s", err)
+		}
+	} else if recipes := p.stagingRecipes(); len(recipes) > 0 {
+		ui.Message("Uploading recipes...")
+		for _, src := range recipes {
+			dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, src))
+			if err := p.uploadFile(ui, comm, dst, src); err != nil {
+				return fmt.Errorf("Error uploading recipe: %s", err)
+			}
+		}
+	}
+
+	if p.config.inlineRecipe != nil {
+		if err := p.uploadInlineRecipe(ui, comm); err != nil {
+			return fmt.Errorf("Error uploading inline recipe: %s", err)
+		}
+	}
+
+	if p.collectsEvents() {
+		if err := p.uploadEventsConfig(ui, comm); err != nil {
+			return fmt.Errorf("Error uploading Itamae configuration: %s", err)
+		}
 	}
 	return nil
 }
@@ -533,6 +1393,7 @@ func (p *Provisioner) uploadFile(ui packer.Ui, comm packer.Communicator, dst, sr
 	}()
 
 	ui.Message(fmt.Sprintf("Uploading file: %s", src))
+	p.machine(ui, "upload", "file", src, dst)
 	return comm.Upload(dst, f, nil)
 }
 
@@ -543,5 +1404,6 @@ func (p *Provisioner) uploadDir(ui packer.Ui, comm packer.Communicator, dst, src
 	if ok := strings.HasSuffix(src, "/"); !ok {
 		src += "/"
 	}
+	p.machine(ui, "upload", "directory", src, dst)
 	return comm.UploadDir(dst, src, nil)
 }
@@ -43,7 +43,7 @@ func TestProvisionerPrepare_InvalidKey(t *testing.T) {
 	}
 }
 
-func TestProvisioner_RetryFunc(t *testing.T) {
+func TestProvisioner_RetryWithPolicy(t *testing.T) {
 	var err error
 	var p Provisioner
 
@@ -56,7 +56,7 @@ func TestProvisioner_RetryFunc(t *testing.T) {
 	}
 	defer os.Remove(recipeFile.Name())
 
-	retry := func() error {
+	retry := func(attempt int) error {
 		log.Printf("Retrying, attempt number %d", count)
 		if count == 2 {
 			return nil
@@ -77,7 +77,7 @@ func TestProvisioner_RetryFunc(t *testing.T) {
 		t.Errorf("should not error, but got: %s", err)
 	}
 
-	err = p.retryFunc(p.config.InstallRetryTimeout, retry)
+	err = p.retryWithPolicy(testUI(nil), p.installRetryPolicy(), retry)
 	if err != nil {
 		t.Errorf("should not error, but got: %s", err)
 	}
@@ -93,7 +93,7 @@ func TestProvisioner_RetryFunc(t *testing.T) {
 		t.Errorf("should not error, but got: %s", err)
 	}
 
-	err = p.retryFunc(p.config.InstallRetryTimeout, retry)
+	err = p.retryWithPolicy(testUI(nil), p.installRetryPolicy(), retry)
 	if err == nil {
 		t.Errorf("should be an error when retrying a function")
 	}
@@ -158,13 +158,19 @@ func TestProvisionerPrepare_Defaults(t *testing.T) {
 		t.Errorf("should be an error if recipes list is empty")
 	}
 
+	directory, err := ioutil.TempDir("", "recipes")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.Remove(directory)
+
 	config["recipes"] = []string{
-		os.TempDir(),
+		directory,
 	}
 
 	err = p.Prepare(config)
 	if err == nil {
-		t.Errorf("should be an error if recipe file points to a directory")
+		t.Errorf("should be an error if recipe directory contains no recipes")
 	}
 
 	config["recipes"] = []string{
@@ -308,10 +314,35 @@ func TestProvisionerPrepare_Defaults(t *testing.T) {
 			kind, len(p.config.Recipes), reflect.Slice, 0)
 	}
 
+	if p.config.CookbooksPath != DefaultCookbooksPath {
+		t.Errorf("incorrect cookbooks_path, given \"%s\", want \"%s\"",
+			p.config.CookbooksPath, DefaultCookbooksPath)
+	}
+
+	if p.config.RolesPath != DefaultRolesPath {
+		t.Errorf("incorrect roles_path, given \"%s\", want \"%s\"",
+			p.config.RolesPath, DefaultRolesPath)
+	}
+
 	if p.config.IgnoreExitCodes {
 		t.Errorf("incorrect ignore_exit_codes, given: \"%v\", want \"%v\"",
 			p.config.IgnoreExitCodes, false)
 	}
+
+	if ok := reflect.DeepEqual(p.config.ValidExitCodes, DefaultValidExitCodes); !ok {
+		t.Errorf("incorrect valid_exit_codes, given: \"%v\", want \"%v\"",
+			p.config.ValidExitCodes, DefaultValidExitCodes)
+	}
+
+	if ok := reflect.DeepEqual(p.config.InstallValidExitCodes, DefaultInstallValidExitCodes); !ok {
+		t.Errorf("incorrect install_valid_exit_codes, given: \"%v\", want \"%v\"",
+			p.config.InstallValidExitCodes, DefaultInstallValidExitCodes)
+	}
+
+	if p.config.FailOnChange {
+		t.Errorf("incorrect fail_on_change, given: \"%v\", want \"%v\"",
+			p.config.FailOnChange, false)
+	}
 }
 
 func TestProvisionerPrepare_EnvironmentVars(t *testing.T) {
@@ -1558,7 +1589,160 @@ func TestProvisionerProvision_Recipes(t *testing.T) {
 }
 
 func TestProvisionerProvision_IgnoreExitCodes(t *testing.T) {
-	// XXX(kwilczynski): How to test this?
+	var err error
+	var p Provisioner
+
+	ui := testUI(nil)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["ignore_exit_codes"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return "", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+}
+
+func TestProvisionerProvision_ValidExitCodes(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	ui := testUI(nil)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	status := 0
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return "", status
+		}
+		return "", 0
+	})
+
+	tests := []struct {
+		codes  []int
+		change bool
+		status int
+		valid  bool
+	}{
+		{nil, false, 0, true},
+		{nil, false, 2, true},
+		{nil, false, 1, false},
+		{nil, true, 2, false},
+		{nil, true, 0, true},
+		{[]int{0, 1, 2}, false, 1, true},
+		{[]int{0}, false, 2, false},
+	}
+
+	for _, tt := range tests {
+		p = Provisioner{}
+		delete(config, "valid_exit_codes")
+
+		if tt.codes != nil {
+			config["valid_exit_codes"] = tt.codes
+		}
+
+		config["fail_on_change"] = tt.change
+		err = p.Prepare(config)
+		if err != nil {
+			t.Errorf("should not error, but got: %s", err)
+		}
+
+		status = tt.status
+
+		err = p.Provision(ui, comm)
+		if tt.valid && err != nil {
+			t.Errorf("should not error for %+v, but got: %s", tt, err)
+		}
+
+		if !tt.valid && err == nil {
+			t.Errorf("should be an error for %+v", tt)
+		}
+
+		if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("Exit status %d", tt.status)) {
+			t.Errorf("should include exit status %d, but got: %s", tt.status, err)
+		}
+	}
+}
+
+func TestProvisionerProvision_InstallValidExitCodes(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	ui := testUI(nil)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "gem install") {
+			return "", 3
+		}
+		return "", 0
+	})
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	p.config.InstallRetryTimeout = 0
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Exit status 3") {
+		t.Errorf("should be an error naming exit status 3, but got: %v", err)
+	}
+
+	p = Provisioner{}
+
+	config["install_valid_exit_codes"] = []int{0, 3}
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
 }
 
 func TestProvisionerProvision_PreventSudo(t *testing.T) {
@@ -1726,3 +1910,144 @@ func TestProvisioner_Cancel(t *testing.T) {
 		t.Errorf("should not error, but got: %s", err)
 	}
 }
+
+func TestProvisionerPrepare_RemoteRecipes(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	nodeFile, err := ioutil.TempFile("", "node.json")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(nodeFile.Name())
+
+	config["remote_recipes"] = []string{
+		"/opt/provisioning/does/not/exist/on/host.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	p = Provisioner{}
+
+	config["remote_recipes"] = []string{
+		"relative/recipe.rb",
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if remote_recipes contains a relative path")
+	}
+
+	p = Provisioner{}
+
+	config["remote_recipes"] = []string{
+		"/opt/provisioning/default.rb",
+	}
+
+	config["remote_node_json"] = "node.json"
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if remote_node_json is a relative path")
+	}
+
+	p = Provisioner{}
+
+	config["node_json"] = nodeFile.Name()
+	config["remote_node_json"] = "/opt/provisioning/node.json"
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if both node_json and remote_node_json are set")
+	}
+
+	p = Provisioner{}
+	delete(config, "node_json")
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+}
+
+func TestProvisionerProvision_RemoteRecipes(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	ui := testUI(nil)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["remote_recipes"] = []string{
+		"/opt/provisioning/base.rb",
+	}
+
+	config["remote_node_json"] = "/opt/provisioning/node.json"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	p.config.PackerBuildName = "virtualbox"
+	p.config.PackerBuilderType = "iso"
+
+	comm := testCommandCommunicator(nil)
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	for _, expected := range []string{
+		"sudo test -f '/opt/provisioning/node.json'",
+		"sudo test -f '/opt/provisioning/base.rb'",
+	} {
+		if ok := strings.Contains(strings.Join(comm.Commands, "\n"), expected); !ok {
+			t.Errorf("should check remote file, but got: %v", comm.Commands)
+		}
+	}
+
+	expected := fmt.Sprintf("cd %s && "+
+		"PACKER_BUILD_NAME='virtualbox' "+
+		"PACKER_BUILDER_TYPE='iso' "+
+		"sudo -E itamae local --detailed-exitcode "+
+		"--node-json='/opt/provisioning/node.json' %s /opt/provisioning/base.rb",
+		p.config.StagingDir,
+		recipeFile.Name())
+
+	if comm.StartCmd.Command != expected {
+		t.Errorf("incorrect execute_command, given: \"%v\", want \"%v\"",
+			comm.StartCmd.Command, expected)
+	}
+
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "test -f '/opt/provisioning/base.rb'") {
+			return "", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if remote recipe does not exist")
+	}
+
+	for _, command := range comm.Commands {
+		if strings.Contains(command, "itamae local") {
+			t.Errorf("should not execute itamae, but got: %s", command)
+		}
+	}
+}
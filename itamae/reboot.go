@@ -0,0 +1,134 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	DefaultRebootMarkerName = "packer-itamae-reboot-required"
+
+	//
+	BootIDCommand = "cat /proc/sys/kernel/random/boot_id"
+)
+
+//
+func (p *Provisioner) rebootMarkerPath() string {
+	return filepath.ToSlash(filepath.Join(p.config.StagingDir, DefaultRebootMarkerName))
+}
+
+//
+func (p *Provisioner) rebootIfRequested(ui packer.Ui, comm packer.Communicator, reboots *int) (bool, error) {
+	requested, err := p.rebootRequested(ui, comm)
+	if err != nil {
+		return false, fmt.Errorf("Error checking reboot marker: %s", err)
+	}
+
+	if !requested {
+		return false, nil
+	}
+
+	*reboots++
+	if *reboots > p.config.MaxReboots {
+		return false, fmt.Errorf("Error rebooting guest: recipes requested more than %d reboots", p.config.MaxReboots)
+	}
+
+	ui.Say(fmt.Sprintf("Recipes requested a reboot, rebooting guest (%d of at most %d)...",
+		*reboots, p.config.MaxReboots))
+
+	p.machine(ui, "reboot", "start", strconv.Itoa(*reboots))
+	start := time.Now()
+	if err := p.reboot(ui, comm); err != nil {
+		return false, fmt.Errorf("Error rebooting guest: %s", err)
+	}
+	p.machine(ui, "reboot", "end", strconv.Itoa(*reboots))
+
+	ui.Message(fmt.Sprintf("Guest rebooted in %s, resuming provisioning...",
+		time.Since(start).Round(time.Second)))
+
+	//
+	ui.Message("Creating staging directory...")
+	if err := p.createDir(ui, comm, p.config.StagingDir); err != nil {
+		return false, fmt.Errorf("Error creating staging directory: %s", err)
+	}
+
+	err = p.withTimeout("upload", p.config.UploadTimeout, func() error {
+		return p.uploadStagingFiles(ui, comm)
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error uploading to staging directory: %s", err)
+	}
+	return true, nil
+}
+
+//
+func (p *Provisioner) rebootRequested(ui packer.Ui, comm packer.Communicator) (bool, error) {
+	marker := p.rebootMarkerPath()
+
+	_, status, err := runRemoteCommand(comm, fmt.Sprintf("test -f '%s'", marker))
+	if err != nil || status != 0 {
+		return false, err
+	}
+
+	cmd := &packer.RemoteCmd{
+		Command: p.guestCommands.RemoveDir(marker),
+	}
+	if err := cmd.StartWithUi(comm, ui); err != nil {
+		return false, err
+	}
+
+	if cmd.ExitStatus != 0 {
+		return false, fmt.Errorf("Non-zero exit status %d. See output above for more information.", cmd.ExitStatus)
+	}
+	return true, nil
+}
+
+//
+func (p *Provisioner) reboot(ui packer.Ui, comm packer.Communicator) error {
+	before, _, err := runRemoteCommand(comm, BootIDCommand)
+	if err != nil {
+		return err
+	}
+	before = strings.TrimSpace(before)
+
+	ui.Message(fmt.Sprintf("Executing: %s", p.config.RebootCommand))
+
+	//
+	cmd := &packer.RemoteCmd{
+		Command: p.config.RebootCommand,
+	}
+	if err := comm.Start(cmd); err != nil {
+		return err
+	}
+
+	ui.Message(fmt.Sprintf("Waiting up to %s for the guest to come back...", p.config.RebootTimeout))
+
+	deadline := time.Now().Add(p.config.RebootTimeout)
+	down := false
+
+	for {
+		time.Sleep(DefaultRebootPollInterval)
+
+		after, status, err := runRemoteCommand(comm, BootIDCommand)
+		after = strings.TrimSpace(after)
+
+		switch {
+		case err != nil || status != 0:
+			down = true
+		case before != "" && after != "" && after != before:
+			return nil
+		case (before == "" || after == "") && down:
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("guest did not come back within reboot_timeout of %s", p.config.RebootTimeout)
+		}
+	}
+}
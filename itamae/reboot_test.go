@@ -0,0 +1,235 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProvisionerPrepare_RebootOnRequest(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["reboot_on_request"] = true
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if reboot_on_request is set without isolate_recipes")
+	}
+
+	p = Provisioner{}
+
+	config["isolate_recipes"] = true
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+}
+
+func TestProvisionerProvision_RebootOnRequest(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["reboot_on_request"] = true
+	config["isolate_recipes"] = true
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	DefaultRebootPollInterval = time.Millisecond
+
+	rebooted := false
+	markers := 0
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		switch {
+		case strings.HasPrefix(command, "test -f '"+p.rebootMarkerPath()+"'"):
+			markers++
+			if markers == 1 {
+				return "", 0
+			}
+			return "", 1
+		case command == "sudo shutdown -r now":
+			rebooted = true
+		case command == BootIDCommand:
+			if rebooted {
+				return "after\n", 0
+			}
+			return "before\n", 0
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if !rebooted {
+		t.Errorf("should reboot the guest, but got: %v", comm.Commands)
+	}
+
+	commands := testItamaeCommands(comm.Commands)
+	if len(commands) != 1 {
+		t.Fatalf("should not execute recipes again after reboot, but got: %v", commands)
+	}
+
+	if !strings.Contains(commands[0], "PACKER_REBOOT_MARKER='"+p.rebootMarkerPath()+"'") {
+		t.Errorf("should export reboot marker, but got: %s", commands[0])
+	}
+
+	if uploads := strings.Count(buffer.String(), "Uploading file: "+recipeFile.Name()); uploads != 2 {
+		t.Errorf("should upload recipes again after reboot, but got %d uploads", uploads)
+	}
+
+	expected := []string{
+		"Recipes requested a reboot%!(PACKER_COMMA) rebooting guest (1 of at most 3)...",
+		",itamae,reboot,end,1",
+	}
+
+	for _, message := range expected {
+		if ok := strings.Contains(buffer.String(), message); !ok {
+			t.Errorf("should include %q, but got: %s", message, buffer)
+		}
+	}
+}
+
+func TestProvisionerProvision_RebootOnRequestIsolated(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb": `package "kernel"`,
+		"app.rb":  `package "nginx"`,
+		"web.rb":  `service "nginx"`,
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{"base.rb", "app.rb", "web.rb"}
+	config["isolate_recipes"] = true
+	config["reboot_on_request"] = true
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	DefaultRebootPollInterval = time.Millisecond
+
+	rebooted := 0
+	markers := 0
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		switch {
+		case strings.HasPrefix(command, "test -f '"+p.rebootMarkerPath()+"'"):
+			markers++
+			if markers == 1 {
+				return "", 0
+			}
+			return "", 1
+		case command == "sudo shutdown -r now":
+			rebooted++
+		case command == BootIDCommand:
+			return fmt.Sprintf("boot-%d\n", rebooted), 0
+		}
+		return "", 0
+	})
+
+	err = p.Provision(testUI(nil), comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if rebooted != 1 {
+		t.Errorf("incorrect number of reboots, given %d, want %d", rebooted, 1)
+	}
+
+	if markers != 3 {
+		t.Errorf("should check reboot marker after each recipe, but got %d checks", markers)
+	}
+
+	commands := testItamaeCommands(comm.Commands)
+	if len(commands) != 3 {
+		t.Fatalf("should resume from the next recipe after reboot, but got: %v", commands)
+	}
+
+	for idx, recipe := range []string{"base.rb", "app.rb", "web.rb"} {
+		if ok := strings.HasSuffix(commands[idx], recipe); !ok {
+			t.Errorf("incorrect recipe order, given %s, want %s", commands[idx], recipe)
+		}
+	}
+}
+
+func TestProvisionerProvision_RebootTimeout(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["reboot_on_request"] = true
+	config["isolate_recipes"] = true
+	config["reboot_timeout"] = "10ms"
+	config["max_reboots"] = 1
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	DefaultRebootPollInterval = time.Millisecond
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if command == BootIDCommand {
+			return "before\n", 0
+		}
+		return "", 0
+	})
+
+	err = p.Provision(testUI(nil), comm)
+	if err == nil || !strings.Contains(err.Error(), "did not come back within reboot_timeout") {
+		t.Errorf("should be an error if the guest does not come back, but got: %v", err)
+	}
+}
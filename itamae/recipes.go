@@ -0,0 +1,154 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	//
+	RecipeExtension = ".rb"
+)
+
+//
+func (p *Provisioner) expandRecipe(recipe, config string) ([]string, error) {
+	pattern := p.prefixPath(recipe, p.config.SourceDir)
+
+	var paths []string
+
+	if isGlob(recipe) {
+		matches, err := globFiles(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s is invalid: %s", config, pattern, err)
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: %s does not match any files", config, pattern)
+		}
+		paths = matches
+	} else {
+		fi, err := os.Stat(pattern)
+		if err != nil || !fi.IsDir() {
+			return []string{recipe}, nil
+		}
+
+		matches, err := walkFiles(pattern, func(name string) bool {
+			return filepath.Ext(name) == RecipeExtension
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s is invalid: %s", config, pattern, err)
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: %s does not contain any recipes", config, pattern)
+		}
+		paths = matches
+	}
+
+	if p.config.SourceDir == "" {
+		return paths, nil
+	}
+
+	for idx, name := range paths {
+		rel, err := filepath.Rel(p.config.SourceDir, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s is invalid: %s", config, name, err)
+		}
+		paths[idx] = filepath.ToSlash(rel)
+	}
+	return paths, nil
+}
+
+//
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+//
+func globFiles(pattern string) ([]string, error) {
+	pattern = path.Clean(filepath.ToSlash(pattern))
+
+	segments := strings.Split(pattern, "/")
+	for _, segment := range segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	root := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if isGlob(segment) {
+			break
+		}
+		root = append(root, segment)
+	}
+
+	base := strings.Join(root, "/")
+	if len(root) == 0 {
+		base = "."
+	} else if base == "" {
+		base = "/"
+	}
+
+	if _, err := os.Stat(base); os.IsNotExist(err) {
+		return []string{}, nil
+	}
+
+	return walkFiles(base, func(name string) bool {
+		return matchGlob(segments, strings.Split(filepath.ToSlash(name), "/"))
+	})
+}
+
+//
+func matchGlob(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for idx := 0; idx <= len(name); idx++ {
+				if matchGlob(pattern[1:], name[idx:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+//
+func walkFiles(root string, match func(string) bool) ([]string, error) {
+	files := make([]string, 0)
+
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		if match(path) {
+			files = append(files, filepath.ToSlash(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
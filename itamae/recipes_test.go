@@ -0,0 +1,276 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_RecipeGlobs(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"default.rb":            "",
+		"README.md":             "",
+		"nginx/default.rb":      "",
+		"nginx/ssl.rb":          "",
+		"nginx/templates/a.erb": "",
+		"ruby/install/rbenv.rb": "",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{
+		"**/*.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := []string{
+		"default.rb",
+		"nginx/default.rb",
+		"nginx/ssl.rb",
+		"ruby/install/rbenv.rb",
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+
+	p = Provisioner{}
+
+	config["recipes"] = []string{
+		"default.rb",
+		"nginx/s*.rb",
+		"ruby/*/*.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected = []string{
+		"default.rb",
+		"nginx/ssl.rb",
+		"ruby/install/rbenv.rb",
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+
+	p = Provisioner{}
+
+	config["recipes"] = []string{
+		"apache/*.rb",
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if recipe pattern does not match any files")
+	}
+
+	p = Provisioner{}
+
+	config["recipes"] = []string{
+		"nginx/[.rb",
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if recipe pattern is malformed")
+	}
+}
+
+func TestProvisionerPrepare_RecipeGlobsRelative(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"recipes/default.rb": "",
+		"recipes/nginx.rb":   "",
+	})
+	defer os.RemoveAll(directory)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unable to get current directory: %s", err)
+	}
+	defer os.Chdir(cwd)
+
+	if err := os.Chdir(directory); err != nil {
+		t.Fatalf("unable to change directory: %s", err)
+	}
+
+	config["recipes"] = []string{
+		"./recipes/*.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := []string{
+		"recipes/default.rb",
+		"recipes/nginx.rb",
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+}
+
+func TestProvisionerPrepare_RecipeDirectories(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"nginx/ssl.rb":          "",
+		"nginx/default.rb":      "",
+		"nginx/templates/a.erb": "",
+		"nginx/vhosts/www.rb":   "",
+		"empty/README.md":       "",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{
+		"nginx",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := []string{
+		"nginx/default.rb",
+		"nginx/ssl.rb",
+		"nginx/vhosts/www.rb",
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+
+	p = Provisioner{}
+	delete(config, "source_directory")
+
+	config["recipes"] = []string{
+		filepath.Join(directory, "nginx", "vhosts"),
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected = []string{
+		filepath.ToSlash(filepath.Join(directory, "nginx", "vhosts", "www.rb")),
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+
+	p = Provisioner{}
+
+	config["recipes"] = []string{
+		filepath.Join(directory, "empty"),
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if recipe directory contains no recipes")
+	}
+}
+
+func TestProvisionerProvision_RecipeOrder(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	comm := testCommunicator()
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"b.rb":   "",
+		"a.rb":   "",
+		"c/d.rb": "",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{
+		"**/*.rb",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := "1. a.rb\n"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include recipe order, but got: %s", buffer)
+	}
+
+	expected = "3. c/d.rb\n"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include recipe order, but got: %s", buffer)
+	}
+
+	expected = "a.rb b.rb c/d.rb"
+	if ok := strings.HasSuffix(comm.StartCmd.Command, expected); !ok {
+		t.Errorf("incorrect execute_command, given: \"%v\", want \"%v\"",
+			comm.StartCmd.Command, expected)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.rb", "default.rb", true},
+		{"*.rb", "nginx/default.rb", false},
+		{"**/*.rb", "default.rb", true},
+		{"**/*.rb", "nginx/vhosts/default.rb", true},
+		{"nginx/**", "nginx/vhosts/default.rb", true},
+		{"nginx/**/ssl.rb", "nginx/ssl.rb", true},
+		{"nginx/**/ssl.rb", "apache/ssl.rb", false},
+		{"nginx/?.rb", "nginx/a.rb", true},
+		{"nginx/[a-c].rb", "nginx/d.rb", false},
+	}
+
+	for _, tt := range tests {
+		match := matchGlob(strings.Split(tt.pattern, "/"), strings.Split(tt.name, "/"))
+		if match != tt.match {
+			t.Errorf("incorrect match for \"%s\" and \"%s\", given %v, want %v",
+				tt.pattern, tt.name, match, tt.match)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+//
+type commandError struct {
+	status int
+	output string
+	err    error
+}
+
+//
+func (e *commandError) Error() string {
+	return e.err.Error()
+}
+
+//
+type retryPolicy struct {
+	name        string
+	maxAttempts int
+	timeout     time.Duration
+	delay       time.Duration
+	maxDelay    time.Duration
+	jitter      bool
+	exitCodes   []int
+	patterns    []*regexp.Regexp
+}
+
+//
+func (p *Provisioner) installRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		name:        "Install",
+		maxAttempts: p.config.InstallMaxAttempts,
+		timeout:     p.config.InstallRetryTimeout,
+		delay:       p.config.InstallRetryDelay,
+		maxDelay:    p.config.InstallRetryMaxDelay,
+		jitter:      true,
+		exitCodes:   p.config.InstallRetryExitCodes,
+		patterns:    p.config.installRetryPatterns,
+	}
+}
+
+//
+func (p *Provisioner) executeRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		name:        "Execute",
+		maxAttempts: p.config.ExecuteRetries + 1,
+		timeout:     time.Duration(math.MaxInt64),
+		delay:       p.config.ExecuteRetryDelay,
+		maxDelay:    p.config.ExecuteRetryDelay,
+		exitCodes:   p.config.ExecuteRetryExitCodes,
+		patterns:    p.config.executeRetryPatterns,
+	}
+}
+
+//
+func (p *Provisioner) retryWithPolicy(ui packer.Ui, policy *retryPolicy, f func(int) error) error {
+	start := time.Now()
+	delay := policy.delay
+
+	for attempt := 1; ; attempt++ {
+		err := f(attempt)
+		if err == nil {
+			return nil
+		}
+
+		ok, reason := policy.retryable(err)
+		if !ok {
+			ui.Error(fmt.Sprintf("%s attempt %d failed and will not be retried: %s",
+				policy.name, attempt, reason))
+			return err
+		}
+
+		if policy.maxAttempts > 0 && attempt >= policy.maxAttempts {
+			ui.Error(fmt.Sprintf("%s attempt %d failed, giving up after %d attempts: %s",
+				policy.name, attempt, attempt, reason))
+			return err
+		}
+
+		wait := delay
+		if policy.jitter {
+			wait = jitter(delay)
+		}
+		if policy.timeout-time.Since(start) < wait {
+			ui.Error(fmt.Sprintf("%s attempt %d failed, giving up after %s: %s",
+				policy.name, attempt, time.Since(start), reason))
+			return err
+		}
+
+		log.Printf("Retrying due to error: %v", err)
+		ui.Message(fmt.Sprintf("%s attempt %d failed (%s), retrying in %s...",
+			policy.name, attempt, reason, wait))
+		time.Sleep(wait)
+
+		delay *= 2
+		if delay > policy.maxDelay {
+			delay = policy.maxDelay
+		}
+	}
+}
+
+//
+func (r *retryPolicy) retryable(err error) (bool, string) {
+	rules := len(r.exitCodes) > 0 || len(r.patterns) > 0
+
+	switch e := err.(type) {
+	case *timeoutError:
+		return !e.final, e.Error()
+	case *commandError:
+		if !rules {
+			return true, fmt.Sprintf("exit status %d", e.status)
+		}
+
+		for _, code := range r.exitCodes {
+			if e.status == code {
+				return true, fmt.Sprintf("exit status %d is retryable", e.status)
+			}
+		}
+
+		for _, pattern := range r.patterns {
+			if pattern.MatchString(e.output) {
+				return true, fmt.Sprintf("output matches %q", pattern.String())
+			}
+		}
+		return false, fmt.Sprintf("exit status %d is not retryable", e.status)
+	}
+	//
+	return true, err.Error()
+}
+
+//
+func compileRetryPatterns(patterns []string, config string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for idx, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %s is invalid: %s", config, idx, pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+//
+func jitter(delay time.Duration) time.Duration {
+	if delay <= 1 {
+		return delay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)))
+}
@@ -0,0 +1,327 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testInstallAttempts(commands []string) int {
+	attempts := 0
+	for _, command := range commands {
+		if strings.Contains(command, "gem install") {
+			attempts++
+		}
+	}
+	return attempts
+}
+
+func TestProvisionerPrepare_InstallRetry(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if p.config.InstallRetryDelay != DefaultRetrySleep {
+		t.Errorf("incorrect install_retry_delay, given %s, want %s",
+			p.config.InstallRetryDelay, DefaultRetrySleep)
+	}
+
+	if p.config.InstallRetryMaxDelay != DefaultRetryMaxDelay {
+		t.Errorf("incorrect install_retry_max_delay, given %s, want %s",
+			p.config.InstallRetryMaxDelay, DefaultRetryMaxDelay)
+	}
+
+	p = Provisioner{}
+
+	config["install_retry_patterns"] = []string{"("}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if install_retry_patterns are invalid")
+	}
+
+	p = Provisioner{}
+	delete(config, "install_retry_patterns")
+
+	config["install_max_attempts"] = -1
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if install_max_attempts is negative")
+	}
+}
+
+func TestProvisionerProvision_InstallRetry(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["install_retry_delay"] = "1ms"
+	config["install_retry_patterns"] = []string{"Temporary failure"}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	attempts := 0
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "gem install") {
+			attempts++
+			if attempts == 1 {
+				return "Temporary failure resolving 'rubygems.org'\n", 1
+			}
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if attempts := testInstallAttempts(comm.Commands); attempts != 2 {
+		t.Errorf("incorrect number of install attempts, given %d, want %d", attempts, 2)
+	}
+
+	expected := `Install attempt 1 failed (output matches "Temporary failure")`
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include retry reason, but got: %s", buffer)
+	}
+
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "gem install") {
+			return "ERROR: Failed to build gem native extension.\n", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if install fails")
+	}
+
+	if attempts := testInstallAttempts(comm.Commands); attempts != 1 {
+		t.Errorf("incorrect number of install attempts, given %d, want %d", attempts, 1)
+	}
+
+	p = Provisioner{}
+	delete(config, "install_retry_patterns")
+
+	config["install_max_attempts"] = 3
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "gem install") {
+			return "", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if install fails")
+	}
+
+	if attempts := testInstallAttempts(comm.Commands); attempts != 3 {
+		t.Errorf("incorrect number of install attempts, given %d, want %d", attempts, 3)
+	}
+}
+
+func TestProvisionerProvision_InstallAttemptTimeout(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["install_retry_delay"] = "1ms"
+	config["install_attempt_timeout"] = "10ms"
+	config["install_retry_exit_codes"] = []int{75}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	var attempts int32
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "gem install") {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := "Install attempt 1 failed (install timed out after"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include retry reason, but got: %s", buffer)
+	}
+}
+
+func TestRetryPolicy_Retryable(t *testing.T) {
+	policy := &retryPolicy{}
+
+	if ok, _ := policy.retryable(fmt.Errorf("error")); !ok {
+		t.Errorf("should retry any error without rules")
+	}
+
+	policy = &retryPolicy{
+		exitCodes: []int{75},
+		patterns:  []*regexp.Regexp{regexp.MustCompile(`Connection reset`)},
+	}
+
+	testCases := []struct {
+		err       error
+		retryable bool
+	}{
+		{fmt.Errorf("error"), true},
+		{&timeoutError{phase: "install"}, true},
+		{&commandError{status: 75, err: fmt.Errorf("error")}, true},
+		{&commandError{status: 1, output: "Connection reset by peer", err: fmt.Errorf("error")}, true},
+		{&commandError{status: 1, output: "Syntax error", err: fmt.Errorf("error")}, false},
+	}
+
+	for _, tc := range testCases {
+		if ok, reason := policy.retryable(tc.err); ok != tc.retryable {
+			t.Errorf("incorrect retryable for %v, given %t (%s), want %t", tc.err, ok, reason, tc.retryable)
+		}
+	}
+}
+
+func TestProvisionerProvision_ExecuteRetries(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["execute_retries"] = 2
+	config["execute_retry_delay"] = "1ms"
+	config["execute_retry_patterns"] = []string{"Failed to fetch"}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	attempts := 0
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			attempts++
+			if attempts < 3 {
+				return "E: Failed to fetch http://archive.ubuntu.com/\n", 1
+			}
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 3 {
+		t.Errorf("incorrect number of runs, given %d, want %d", len(commands), 3)
+	}
+
+	if uploads := strings.Count(buffer.String(), "Uploading file: "+recipeFile.Name()); uploads != 1 {
+		t.Errorf("should upload recipes once, but got %d uploads", uploads)
+	}
+
+	expected := "Executing Itamae%!(PACKER_COMMA) attempt 3 of 3..."
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include attempt number, but got: %s", buffer)
+	}
+
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return "undefined method `pakage'\n", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Errorf("should be an error if Itamae fails")
+	}
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 1 {
+		t.Errorf("incorrect number of runs, given %d, want %d", len(commands), 1)
+	}
+
+	p = Provisioner{}
+
+	config["execute_retries"] = -1
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if execute_retries is negative")
+	}
+}
@@ -0,0 +1,174 @@
+package itamaelocal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	//
+	DefaultCookbooksPath = "cookbooks"
+
+	//
+	DefaultRolesPath = "roles"
+
+	//
+	DefaultRecipeName = "default"
+)
+
+var (
+	//
+	runListEntryRegexp = regexp.MustCompile(`^(recipe|role)\[([^\[\]]+)\]$`)
+
+	//
+	includeRegexp = regexp.MustCompile(`^\s*(include_recipe|include_role)\s*\(?\s*['"]([^'"]+)['"]\s*\)?\s*(#.*)?$`)
+)
+
+//
+func (p *Provisioner) resolveRunList(entry, config string) ([]string, error) {
+	kind, name, err := parseRunListEntry(entry)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", config, err)
+	}
+
+	if kind == "role" {
+		return p.resolveRole(name, config, make(map[string]bool))
+	}
+
+	recipe, err := p.resolveRecipe(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", config, err)
+	}
+	return []string{recipe}, nil
+}
+
+//
+func (p *Provisioner) resolveRecipe(name string) (string, error) {
+	cookbook, recipe := name, DefaultRecipeName
+	if idx := strings.Index(name, "::"); idx > -1 {
+		cookbook, recipe = name[:idx], name[idx+2:]
+	}
+
+	if cookbook == "" || recipe == "" {
+		return "", fmt.Errorf("recipe name %q is invalid", name)
+	}
+	return path.Join(p.config.CookbooksPath, cookbook, recipe+RecipeExtension), nil
+}
+
+//
+func (p *Provisioner) resolveRole(name, config string, seen map[string]bool) ([]string, error) {
+	if seen[name] {
+		return nil, fmt.Errorf("%s: role %q includes itself", config, name)
+	}
+	seen[name] = true
+	defer delete(seen, name)
+
+	role := path.Join(p.config.RolesPath, name+RecipeExtension)
+	if err := p.validateFileConfig(role, config); err != nil {
+		return nil, err
+	}
+
+	includes, err := parseRoleFile(p.prefixPath(role, p.config.SourceDir))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s is invalid: %s", config, role, err)
+	}
+
+	recipes := make([]string, 0, len(includes))
+	for _, include := range includes {
+		if include.role {
+			paths, err := p.resolveRole(include.name, config, seen)
+			if err != nil {
+				return nil, err
+			}
+			recipes = append(recipes, paths...)
+			continue
+		}
+
+		recipe, err := p.resolveIncludedRecipe(include.name, path.Dir(role))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s is invalid: %s", config, role, err)
+		}
+		recipes = append(recipes, recipe)
+	}
+
+	if len(recipes) == 0 {
+		return nil, fmt.Errorf("%s: role %q does not include any recipes", config, name)
+	}
+	return recipes, nil
+}
+
+//
+func (p *Provisioner) resolveIncludedRecipe(name, dir string) (string, error) {
+	if !strings.Contains(name, "/") && path.Ext(name) != RecipeExtension {
+		return p.resolveRecipe(name)
+	}
+
+	recipe := path.Clean(name)
+	if !path.IsAbs(recipe) {
+		recipe = path.Join(dir, recipe)
+	}
+
+	fi, err := os.Stat(p.prefixPath(recipe, p.config.SourceDir))
+	if err == nil && fi.IsDir() {
+		return path.Join(recipe, DefaultRecipeName+RecipeExtension), nil
+	}
+
+	if path.Ext(recipe) != RecipeExtension {
+		recipe += RecipeExtension
+	}
+	return recipe, nil
+}
+
+//
+func parseRunListEntry(entry string) (string, string, error) {
+	entry = strings.TrimSpace(entry)
+
+	matches := runListEntryRegexp.FindStringSubmatch(entry)
+	if matches == nil {
+		return "", "", fmt.Errorf("entry %q is not in format 'recipe[name]' or 'role[name]'", entry)
+	}
+	return matches[1], strings.TrimSpace(matches[2]), nil
+}
+
+//
+type roleInclude struct {
+	name string
+	role bool
+}
+
+//
+func parseRoleFile(path string) (includes []roleInclude, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		matches := includeRegexp.FindStringSubmatch(text)
+		if matches == nil {
+			return nil, fmt.Errorf("line %d: roles may only contain include_recipe, "+
+				"include_role and comments, but got: %s", line, text)
+		}
+
+		includes = append(includes, roleInclude{
+			name: matches[2],
+			role: matches[1] == "include_role",
+		})
+	}
+	return includes, scanner.Err()
+}
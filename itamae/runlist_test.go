@@ -0,0 +1,224 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_RunList(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"cookbooks/nginx/default.rb": "",
+		"cookbooks/nginx/ssl.rb":     "",
+		"cookbooks/ruby/default.rb":  "",
+		"site/base/default.rb":       "",
+		"roles/web.rb": strings.Join([]string{
+			`include_role "base"`,
+			`include_recipe "nginx"`,
+			`include_recipe 'nginx::ssl'`,
+		}, "\n"),
+		"roles/base.rb": strings.Join([]string{
+			`# Shared by every role.`,
+			`include_recipe "../site/base"`,
+			`include_recipe("../cookbooks/ruby/default.rb")`,
+		}, "\n"),
+		"roles/loop.rb":  `include_role "loop"`,
+		"roles/empty.rb": `# Nothing to see here.`,
+		"roles/mixed.rb": strings.Join([]string{
+			`include_recipe "nginx" # Web server.`,
+			`package "curl"`,
+		}, "\n"),
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["run_list"] = []string{
+		"recipe[nginx]",
+		"recipe[nginx::ssl]",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := []string{
+		"cookbooks/nginx/default.rb",
+		"cookbooks/nginx/ssl.rb",
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+
+	p = Provisioner{}
+
+	config["recipes"] = []string{
+		"cookbooks/ruby/default.rb",
+	}
+
+	config["run_list"] = []string{
+		"role[web]",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected = []string{
+		"cookbooks/ruby/default.rb",
+		"site/base/default.rb",
+		"cookbooks/ruby/default.rb",
+		"cookbooks/nginx/default.rb",
+		"cookbooks/nginx/ssl.rb",
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+
+	delete(config, "recipes")
+
+	for _, entry := range []string{"recipe[apache]", "role[db]", "role[loop]", "role[empty]", "role[mixed]", "nginx", "recipe[::ssl]"} {
+		p = Provisioner{}
+
+		config["run_list"] = []string{
+			entry,
+		}
+
+		err = p.Prepare(config)
+		if err == nil {
+			t.Errorf("should be an error if run_list contains %s", entry)
+		}
+	}
+
+	p = Provisioner{}
+
+	config["run_list"] = []string{
+		"role[mixed]",
+	}
+
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), `line 2: roles may only contain`) {
+		t.Errorf("should be an error naming the unsupported line, but got: %v", err)
+	}
+}
+
+func TestProvisionerPrepare_RunListPaths(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"site-cookbooks/nginx/default.rb": "",
+		"site-roles/web.rb":               `include_recipe "nginx"`,
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["run_list"] = []string{
+		"role[web]",
+	}
+
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if roles_path does not exist")
+	}
+
+	p = Provisioner{}
+
+	config["cookbooks_path"] = "site-cookbooks"
+	config["roles_path"] = "site-roles"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := []string{
+		"site-cookbooks/nginx/default.rb",
+	}
+
+	if ok := reflect.DeepEqual(p.config.Recipes, expected); !ok {
+		t.Errorf("value given %v, want %v", p.config.Recipes, expected)
+	}
+}
+
+func TestProvisionerProvision_RunList(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	ui := testUI(nil)
+	comm := testCommunicator()
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"cookbooks/nginx/default.rb": "",
+		"cookbooks/nginx/ssl.rb":     "",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["run_list"] = []string{
+		"recipe[nginx::ssl]",
+		"recipe[nginx]",
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	p.config.PackerBuildName = "virtualbox"
+	p.config.PackerBuilderType = "iso"
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	expected := fmt.Sprintf("cd %s && "+
+		"PACKER_BUILD_NAME='virtualbox' "+
+		"PACKER_BUILDER_TYPE='iso' "+
+		"sudo -E itamae local --detailed-exitcode %s",
+		p.config.StagingDir,
+		"cookbooks/nginx/ssl.rb cookbooks/nginx/default.rb")
+
+	if comm.StartCmd.Command != expected {
+		t.Errorf("incorrect execute_command, given: \"%v\", want \"%v\"",
+			comm.StartCmd.Command, expected)
+	}
+}
+
+func TestParseRunListEntry(t *testing.T) {
+	tests := []struct {
+		entry string
+		kind  string
+		name  string
+		valid bool
+	}{
+		{"recipe[nginx]", "recipe", "nginx", true},
+		{"recipe[nginx::ssl]", "recipe", "nginx::ssl", true},
+		{" role[web] ", "role", "web", true},
+		{"role[]", "", "", false},
+		{"cookbook[nginx]", "", "", false},
+		{"nginx", "", "", false},
+	}
+
+	for _, tt := range tests {
+		kind, name, err := parseRunListEntry(tt.entry)
+		if (err == nil) != tt.valid || kind != tt.kind || name != tt.name {
+			t.Errorf("incorrect entry %q, given {%v %v %v}, want {%v %v %v}",
+				tt.entry, kind, name, err == nil, tt.kind, tt.name, tt.valid)
+		}
+	}
+}
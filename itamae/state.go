@@ -0,0 +1,163 @@
+package itamaelocal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+//
+func (p *Provisioner) desiredState(installed string) (string, error) {
+	lines := []string{
+		"command " + p.config.Command,
+		"gems " + strings.Join(p.config.Gems, " "),
+		"installed_gems " + installed,
+		"execute_command " + p.config.ExecuteCommand,
+		"extra_arguments " + strings.Join(p.config.ExtraArguments, " "),
+		"environment_vars " + strings.Join(p.config.Vars, " "),
+		"log_level " + p.config.LogLevel,
+		"shell " + p.config.Shell,
+		"prevent_sudo " + strconv.FormatBool(p.config.PreventSudo),
+		"remote_node_json " + p.config.RemoteNodeJSON,
+		"remote_recipes " + strings.Join(p.config.RemoteRecipes, " "),
+		"recipes " + strings.Join(p.recipes(), " "),
+	}
+
+	if p.config.Color != nil {
+		lines = append(lines, "color "+strconv.FormatBool(*p.config.Color))
+	}
+
+	if p.config.SourceDir != "" {
+		checksums, err := checksumFiles(p.config.SourceDir, nil)
+		if err != nil {
+			return "", err
+		}
+
+		for _, name := range sortedKeys(checksums) {
+			lines = append(lines, fmt.Sprintf("source %s %s", checksums[name], name))
+		}
+	}
+
+	files := map[string]string{
+		"node_json":   p.config.NodeJSON,
+		"node_yaml":   p.config.NodeYAML,
+		"config_file": p.config.ConfigFile,
+	}
+
+	for _, recipe := range p.stagingRecipes() {
+		files["recipe "+recipe] = recipe
+	}
+
+	for _, phase := range p.config.Phases {
+		lines = append(lines, fmt.Sprintf("phase %s recipes %s", phase.Name, strings.Join(phase.Recipes, " ")),
+			fmt.Sprintf("phase %s environment_vars %s", phase.Name, strings.Join(phase.Vars, " ")))
+
+		if phase.PreventSudo != nil {
+			lines = append(lines, fmt.Sprintf("phase %s prevent_sudo %t", phase.Name, *phase.PreventSudo))
+		}
+
+		files["phase "+phase.Name+" node_json"] = phase.NodeJSON
+		files["phase "+phase.Name+" node_yaml"] = phase.NodeYAML
+	}
+
+	for _, name := range sortedKeys(files) {
+		if files[name] == "" {
+			continue
+		}
+
+		sum, err := checksumFile(p.prefixPath(files[name], p.config.SourceDir))
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", name, sum))
+	}
+
+	if p.config.inlineRecipe != nil {
+		lines = append(lines, "inline_recipe "+strings.Join(p.config.inlineRecipe, "\n"))
+	}
+
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//
+func (p *Provisioner) installedGems(comm packer.Communicator) (string, error) {
+	names := make([]string, 0, len(p.config.Gems))
+	for _, gem := range p.config.Gems {
+		if strings.HasPrefix(gem, "-") {
+			continue
+		}
+		names = append(names, shellQuote(strings.SplitN(gem, ":", 2)[0]))
+	}
+
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	command := "gem list --local --exact " + strings.Join(names, " ")
+	if !p.config.PreventSudo {
+		command = "sudo -E " + command
+	}
+
+	stdout, status, err := runRemoteCommand(comm, command)
+	if err != nil {
+		return "", err
+	}
+
+	if status != 0 {
+		return "", fmt.Errorf("%s exited with status %d", command, status)
+	}
+
+	//
+	gems := make([]string, 0)
+	for _, line := range strings.Split(stdout, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			gems = append(gems, line)
+		}
+	}
+	sort.Strings(gems)
+	return strings.Join(gems, ", "), nil
+}
+
+//
+func (p *Provisioner) readState(comm packer.Communicator) (string, error) {
+	command := fmt.Sprintf("cat '%s'", p.config.StateFile)
+	if !p.config.PreventSudo {
+		command = "sudo " + command
+	}
+
+	stdout, status, err := runRemoteCommand(comm, command)
+	if err != nil || status != 0 {
+		return "", err
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+//
+func (p *Provisioner) writeState(ui packer.Ui, comm packer.Communicator, state string) error {
+	command := fmt.Sprintf(`mkdir -p "%s" && echo %s > "%s"`,
+		path.Dir(p.config.StateFile), state, p.config.StateFile)
+	if !p.config.PreventSudo {
+		command = "sudo sh -c " + shellQuote(command)
+	}
+
+	cmd := &packer.RemoteCmd{
+		Command: command,
+	}
+	if err := cmd.StartWithUi(comm, ui); err != nil {
+		return err
+	}
+
+	if cmd.ExitStatus != 0 {
+		return fmt.Errorf("Non-zero exit status %d. See output above for more information.", cmd.ExitStatus)
+	}
+	return nil
+}
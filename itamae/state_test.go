@@ -0,0 +1,233 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_StateFile(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["state_file"] = "/var/lib/itamae/state"
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	p = Provisioner{}
+
+	config["state_file"] = "state"
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if state_file is not an absolute path")
+	}
+
+	p = Provisioner{}
+	delete(config, "state_file")
+
+	config["force"] = true
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if force is set without state_file")
+	}
+}
+
+func TestProvisioner_DesiredState(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb":   `package "curl"`,
+		"node.json": `{"version": 1}`,
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{"base.rb"}
+	config["node_json"] = "node.json"
+	config["state_file"] = "/var/lib/itamae/state"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	state, err := p.desiredState("")
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	if again, _ := p.desiredState(""); again != state {
+		t.Errorf("should be stable, given %s, want %s", again, state)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(directory, "node.json"), []byte(`{"version": 2}`), 0644)
+	if err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+
+	if changed, _ := p.desiredState(""); changed == state {
+		t.Errorf("should change with node attributes, but got: %s", changed)
+	}
+
+	state, _ = p.desiredState("")
+
+	p.config.Gems = []string{"itamae:1.10.2"}
+	if changed, _ := p.desiredState(""); changed == state {
+		t.Errorf("should change with gem versions, but got: %s", changed)
+	}
+
+	state, _ = p.desiredState("itamae (1.10.2)")
+	if changed, _ := p.desiredState("itamae (1.10.3)"); changed == state {
+		t.Errorf("should change with installed gem versions, but got: %s", changed)
+	}
+}
+
+func TestProvisionerProvision_StateFile(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["state_file"] = "/var/lib/itamae/state"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	state, err := p.desiredState("")
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	testState := func(current string) *recordingCommunicator {
+		comm := testCommandCommunicator(func(command string) (string, int) {
+			if command == "sudo cat '/var/lib/itamae/state'" {
+				return current + "\n", 0
+			}
+			return "", 0
+		})
+
+		err = p.Provision(ui, comm)
+		if err != nil {
+			t.Errorf("should not error, but got: %s", err)
+		}
+		return comm
+	}
+
+	comm := testState("")
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 1 {
+		t.Errorf("incorrect number of runs, given %d, want %d", len(commands), 1)
+	}
+
+	expected := `echo ` + state + ` > "/var/lib/itamae/state"`
+	if ok := strings.Contains(strings.Join(comm.Commands, "\n"), expected); !ok {
+		t.Errorf("should update state file, but got: %s", comm.Commands)
+	}
+
+	comm = testState(state)
+
+	if attempts := testInstallAttempts(comm.Commands); attempts != 0 {
+		t.Errorf("should skip install, but got %d attempts", attempts)
+	}
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 0 {
+		t.Errorf("should skip execution, but got %d runs", len(commands))
+	}
+
+	if ok := strings.Contains(buffer.String(), "Guest is already at the desired state "+state); !ok {
+		t.Errorf("should report skipped provisioning, but got: %s", buffer)
+	}
+
+	p.config.Force = true
+	comm = testState(state)
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 1 {
+		t.Errorf("should execute when force is set, but got %d runs", len(commands))
+	}
+
+	p.config.Force = false
+
+	previous, _ := p.desiredState("itamae (1.10.2)")
+
+	installed := "itamae (1.10.3)"
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		switch {
+		case command == "sudo cat '/var/lib/itamae/state'":
+			return previous + "\n", 0
+		case strings.HasPrefix(command, "sudo -E gem list --local --exact 'itamae'"):
+			return installed + "\n", 0
+		case strings.Contains(command, "gem install"):
+			installed = "itamae (1.10.4)"
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	if commands := testItamaeCommands(comm.Commands); len(commands) != 1 {
+		t.Errorf("should execute when installed gems changed, but got %d runs", len(commands))
+	}
+
+	final, _ := p.desiredState("itamae (1.10.4)")
+	commands := strings.Join(comm.Commands, "\n")
+	if ok := strings.Contains(commands, `echo `+final+` >`); !ok {
+		t.Errorf("should record gems installed during provisioning, but got: %s", commands)
+	}
+
+	buffer.Reset()
+
+	comm = testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "gem list") {
+			return "", 1
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error listing installed gems") {
+		t.Errorf("should be an error if installed gems cannot be listed, but got: %v", err)
+	}
+
+	expected = "Unable to list installed gems%!(PACKER_COMMA) assuming none are installed"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include %q, but got: %s", expected, buffer)
+	}
+}
@@ -0,0 +1,152 @@
+package itamaelocal
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	DefaultKillGracePeriod = 5 * time.Second
+)
+
+//
+type timeoutError struct {
+	phase   string
+	elapsed time.Duration
+	final   bool
+	running bool
+}
+
+//
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.phase, e.elapsed)
+}
+
+//
+func (p *Provisioner) startWithTimeout(ui packer.Ui, comm packer.Communicator, cmd *packer.RemoteCmd,
+	phase string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return cmd.StartWithUi(comm, ui)
+	}
+
+	pidFile := p.pidFile(phase)
+	cmd.Command = timeoutCommand(cmd.Command, pidFile)
+
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.StartWithUi(comm, ui)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		ui.Error(fmt.Sprintf("Phase %s exceeded its timeout of %s, terminating remote processes...",
+			phase, timeout))
+		if err := p.killRemote(ui, comm, pidFile); err != nil {
+			ui.Error(fmt.Sprintf("Unable to terminate remote processes: %s", err))
+		}
+
+		return &timeoutError{
+			phase:   phase,
+			elapsed: time.Since(start).Round(time.Millisecond),
+		}
+	}
+}
+
+//
+func (p *Provisioner) withTimeout(phase string, timeout time.Duration, f func() error) error {
+	if timeout <= 0 {
+		return f()
+	}
+
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		//
+		return &timeoutError{
+			phase:   phase,
+			elapsed: time.Since(start).Round(time.Millisecond),
+			final:   true,
+			running: true,
+		}
+	}
+}
+
+//
+func (p *Provisioner) killRemote(ui packer.Ui, comm packer.Communicator, pidFile string) error {
+	kill := "kill"
+	if !p.config.PreventSudo {
+		kill = "sudo kill"
+	}
+
+	//
+	command := fmt.Sprintf("if [ -f '%[1]s' ]; then pgid=$(cat '%[1]s'); "+
+		"%[2]s -TERM -- -$pgid 2>/dev/null; sleep %[3]d; %[2]s -KILL -- -$pgid 2>/dev/null; "+
+		"rm -f '%[1]s'; fi", pidFile, kill, int(DefaultKillGracePeriod.Seconds()))
+
+	cmd := &packer.RemoteCmd{
+		Command: command,
+	}
+	if err := cmd.StartWithUi(comm, ui); err != nil {
+		return err
+	}
+
+	if cmd.ExitStatus != 0 {
+		return fmt.Errorf("Non-zero exit status %d. See output above for more information.", cmd.ExitStatus)
+	}
+	return nil
+}
+
+//
+func (p *Provisioner) cleanupAfterTimeout(ui packer.Ui, comm packer.Communicator, err error) {
+	terr, ok := err.(*timeoutError)
+	if !ok || !p.config.CleanStagingDir {
+		return
+	}
+
+	if terr.running {
+		ui.Error(fmt.Sprintf("Phase %s is still in progress, leaving staging directory %s in place...",
+			terr.phase, p.config.StagingDir))
+		return
+	}
+
+	ui.Message("Removing staging directory after timeout...")
+	p.machine(ui, "cleanup", "start", p.config.StagingDir)
+	if err := p.removeDir(ui, comm, p.config.StagingDir); err != nil {
+		ui.Error(fmt.Sprintf("Unable to remove staging directory: %s", err))
+		return
+	}
+	p.machine(ui, "cleanup", "end", p.config.StagingDir)
+}
+
+//
+func (p *Provisioner) pidFile(phase string) string {
+	return fmt.Sprintf("/tmp/packer-itamae-%s-%s.pid", path.Base(p.config.StagingDir), phase)
+}
+
+//
+func timeoutCommand(command, pidFile string) string {
+	script := fmt.Sprintf(`echo $$ > "%s" && %s`, pidFile, command)
+	return fmt.Sprintf(`setsid sh -c %s; status=$?; rm -f '%s'; exit $status`, shellQuote(script), pidFile)
+}
+
+//
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'"'"'`, -1) + "'"
+}
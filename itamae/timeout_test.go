@@ -0,0 +1,200 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProvisionerProvision_ExecuteTimeout(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &bytes.Buffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["execute_timeout"] = "20ms"
+	config["clean_staging_directory"] = true
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return "", 0
+	})
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "execute timed out after") {
+		t.Fatalf("should be an error naming the execute phase, but got: %v", err)
+	}
+
+	commands := strings.Join(comm.Commands, "\n")
+
+	expected := []string{
+		"setsid sh -c 'echo $$ > \"" + p.pidFile("execute") + "\"",
+		"-TERM -- -$pgid",
+		"rm -rf '" + p.config.StagingDir + "'",
+	}
+
+	for _, command := range expected {
+		if ok := strings.Contains(commands, command); !ok {
+			t.Errorf("should run %q, but got: %s", command, commands)
+		}
+	}
+}
+
+func TestProvisionerProvision_InstallTimeout(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["install_timeout"] = "20ms"
+	config["install_retry_delay"] = "1ms"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "gem install") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return "", 0
+	})
+
+	err = p.Provision(testUI(nil), comm)
+	if err == nil || !strings.Contains(err.Error(), "install timed out after") {
+		t.Fatalf("should be an error naming the install phase, but got: %v", err)
+	}
+
+	if attempts := testInstallAttempts(comm.Commands); attempts != 1 {
+		t.Errorf("incorrect number of install attempts, given %d, want %d", attempts, 1)
+	}
+}
+
+func TestProvisioner_WithTimeout(t *testing.T) {
+	var p Provisioner
+
+	err := p.withTimeout("upload", 10*time.Millisecond, func() error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+
+	if err == nil || !strings.HasPrefix(err.Error(), "upload timed out after") {
+		t.Errorf("should be an error naming the upload phase, but got: %v", err)
+	}
+
+	err = p.withTimeout("upload", 0, func() error {
+		return nil
+	})
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+}
+
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+type slowUploadCommunicator struct {
+	*recordingCommunicator
+
+	release chan struct{}
+}
+
+func (c *slowUploadCommunicator) UploadDir(dst string, src string, exclude []string) error {
+	<-c.release
+	return nil
+}
+
+func TestProvisionerProvision_UploadTimeout(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	buffer := &lockedBuffer{}
+
+	ui := testUI(buffer)
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"default.rb": "",
+	})
+	defer os.RemoveAll(directory)
+
+	config["source_directory"] = directory
+	config["recipes"] = []string{"default.rb"}
+	config["upload_timeout"] = "20ms"
+	config["clean_staging_directory"] = true
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	comm := &slowUploadCommunicator{
+		recordingCommunicator: testCommandCommunicator(nil),
+		release:               make(chan struct{}),
+	}
+	defer close(comm.release)
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "upload timed out after") {
+		t.Fatalf("should be an error naming the upload phase, but got: %v", err)
+	}
+
+	commands := strings.Join(comm.Commands, "\n")
+	if ok := strings.Contains(commands, "rm -rf '"+p.config.StagingDir+"'"); ok {
+		t.Errorf("should not remove staging directory while uploading, but got: %s", commands)
+	}
+
+	expected := "Phase upload is still in progress"
+	if ok := strings.Contains(buffer.String(), expected); !ok {
+		t.Errorf("should include %q, but got: %s", expected, buffer)
+	}
+}
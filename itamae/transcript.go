@@ -0,0 +1,223 @@
+package itamaelocal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	//
+	RedactedValue = "<redacted>"
+
+	//
+	TranscriptTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+//
+type transcript struct {
+	sync.Mutex
+
+	file     *os.File
+	redactor *strings.Replacer
+	commands int
+	closed   bool
+	pending  sync.WaitGroup
+}
+
+//
+type transcriptWriter struct {
+	sync.Mutex
+
+	transcript *transcript
+	id         int
+	stream     string
+	buffer     []byte
+}
+
+//
+type transcriptCommunicator struct {
+	packer.Communicator
+
+	transcript *transcript
+}
+
+//
+func newTranscript(path string, redactions []string) (*transcript, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transcript{
+		file:     f,
+		redactor: strings.NewReplacer(redactions...),
+	}, nil
+}
+
+//
+func (t *transcript) Close() error {
+	done := make(chan struct{})
+	go func() {
+		t.pending.Wait()
+		close(done)
+	}()
+
+	//
+	select {
+	case <-done:
+	case <-time.After(DefaultTranscriptCloseTimeout):
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.closed = true
+	return t.file.Close()
+}
+
+//
+func (t *transcript) record(id int, label, text string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		return
+	}
+
+	fmt.Fprintf(t.file, "%s [%d] %s: %s\n",
+		time.Now().UTC().Format(TranscriptTimeFormat), id, label, t.redactor.Replace(text))
+}
+
+//
+func (t *transcript) writer(id int, stream string) *transcriptWriter {
+	return &transcriptWriter{
+		transcript: t,
+		id:         id,
+		stream:     stream,
+	}
+}
+
+//
+func (w *transcriptWriter) Write(data []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.buffer = append(w.buffer, data...)
+	for {
+		idx := bytes.IndexByte(w.buffer, '\n')
+		if idx < 0 {
+			break
+		}
+
+		w.transcript.record(w.id, w.stream, strings.TrimRight(string(w.buffer[:idx]), "\r"))
+		w.buffer = w.buffer[idx+1:]
+	}
+	return len(data), nil
+}
+
+//
+func (w *transcriptWriter) flush() {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.buffer) > 0 {
+		w.transcript.record(w.id, w.stream, string(w.buffer))
+		w.buffer = nil
+	}
+}
+
+//
+func (c *transcriptCommunicator) Start(rc *packer.RemoteCmd) error {
+	t := c.transcript
+
+	t.Lock()
+	t.commands++
+	id := t.commands
+	t.Unlock()
+
+	stdout := t.writer(id, "stdout")
+	stderr := t.writer(id, "stderr")
+
+	//
+	rc.Lock()
+	cmd := &packer.RemoteCmd{
+		Command: rc.Command,
+		Stdin:   rc.Stdin,
+		Stdout:  transcriptMultiWriter(rc.Stdout, stdout),
+		Stderr:  transcriptMultiWriter(rc.Stderr, stderr),
+	}
+	rc.Unlock()
+
+	start := time.Now()
+
+	t.pending.Add(1)
+
+	t.record(id, "command", cmd.Command)
+	if err := c.Communicator.Start(cmd); err != nil {
+		t.record(id, "error", err.Error())
+		t.pending.Done()
+		return err
+	}
+
+	go func() {
+		defer t.pending.Done()
+
+		cmd.Wait()
+		stdout.flush()
+		stderr.flush()
+
+		t.record(id, "exit", fmt.Sprintf("status %d after %s", cmd.ExitStatus, time.Since(start)))
+		rc.SetExited(cmd.ExitStatus)
+	}()
+	return nil
+}
+
+//
+func (p *Provisioner) transcriptRedactions() []string {
+	vars := make([]string, 0, len(p.config.Vars))
+	vars = append(vars, p.config.Vars...)
+	for _, phase := range p.config.Phases {
+		vars = append(vars, phase.Vars...)
+	}
+
+	redactions := make([]string, 0, 2*(2*len(vars)+len(p.config.LogRedact)))
+
+	//
+	values := make([]string, 0, len(vars))
+	for _, kv := range vars {
+		vs := strings.SplitN(kv, "=", 2)
+		if len(vs) == 2 && vs[1] != "''" {
+			redactions = append(redactions, kv, fmt.Sprintf("%s='%s'", vs[0], RedactedValue))
+
+			value := strings.TrimSuffix(strings.TrimPrefix(vs[1], "'"), "'")
+			values = append(values, strings.Replace(value, `'"'"'`, "'", -1))
+		}
+	}
+
+	//
+	for _, value := range values {
+		redactions = append(redactions, value, RedactedValue)
+	}
+
+	for _, secret := range p.config.LogRedact {
+		if secret != "" {
+			redactions = append(redactions, secret, RedactedValue)
+		}
+	}
+	return redactions
+}
+
+//
+func transcriptMultiWriter(w io.Writer, tw *transcriptWriter) io.Writer {
+	if w == nil {
+		return tw
+	}
+	return io.MultiWriter(w, tw)
+}
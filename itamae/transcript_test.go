@@ -0,0 +1,266 @@
+package itamaelocal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+type hangingCommunicator struct {
+	*recordingCommunicator
+
+	release chan struct{}
+}
+
+func (c *hangingCommunicator) Start(rc *packer.RemoteCmd) error {
+	if !strings.Contains(rc.Command, "itamae local") {
+		return c.recordingCommunicator.Start(rc)
+	}
+
+	c.Lock()
+	c.Commands = append(c.Commands, rc.Command)
+	c.Unlock()
+
+	go func() {
+		<-c.release
+		rc.SetExited(0)
+	}()
+	return nil
+}
+
+func TestProvisionerPrepare_LogFile(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["log_file"] = "/does/not/exist/itamae.log"
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if log_file directory does not exist")
+	}
+
+	p = Provisioner{}
+
+	config["log_file"] = os.TempDir()
+	err = p.Prepare(config)
+	if err == nil {
+		t.Errorf("should be an error if log_file is a directory")
+	}
+}
+
+func TestProvisionerProvision_LogFile(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	directory, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	logFile := filepath.Join(directory, "itamae.log")
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["log_file"] = logFile
+	config["log_redact"] = []string{"token123"}
+	config["environment_vars"] = []string{"SECRET=hunter2", "TOKEN=it's-a-secret"}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	comm := testCommandCommunicator(func(command string) (string, int) {
+		if strings.Contains(command, "itamae local") {
+			return " INFO : Using token123\n INFO : Password is hunter2\n INFO : Token it's-a-secret\n INFO : Done", 2
+		}
+		return "", 0
+	})
+
+	err = p.Provision(testUI(nil), comm)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("should write log file, but got: %s", err)
+	}
+	content := string(data)
+
+	for _, secret := range []string{"hunter2", "token123", "it's-a-secret"} {
+		if ok := strings.Contains(content, secret); ok {
+			t.Errorf("should redact %s, but got: %s", secret, content)
+		}
+	}
+
+	expected := []string{
+		"[1] command: sudo -E gem install",
+		"[1] exit: status 0 after",
+		"SECRET='<redacted>' TOKEN='<redacted>' sudo -E itamae local",
+		"stdout:  INFO : Using <redacted>\n",
+		"stdout:  INFO : Password is <redacted>\n",
+		"stdout:  INFO : Done\n",
+		"exit: status 2 after",
+	}
+
+	for _, message := range expected {
+		if ok := strings.Contains(content, message); !ok {
+			t.Errorf("should include %q, but got: %s", message, content)
+		}
+	}
+
+	install := strings.Index(content, "[1] exit:")
+	mkdir := strings.Index(content, "[2] command:")
+	if install < 0 || mkdir < 0 || install > mkdir {
+		t.Errorf("should record commands in order, but got: %s", content)
+	}
+}
+
+func TestProvisionerProvision_LogFileTimeout(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	recipeFile, err := ioutil.TempFile("", "recipe.rb")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(recipeFile.Name())
+
+	directory, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	logFile := filepath.Join(directory, "itamae.log")
+
+	config["recipes"] = []string{
+		recipeFile.Name(),
+	}
+
+	config["log_file"] = logFile
+	config["execute_timeout"] = "20ms"
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	defer func(timeout time.Duration) {
+		DefaultTranscriptCloseTimeout = timeout
+	}(DefaultTranscriptCloseTimeout)
+	DefaultTranscriptCloseTimeout = 10 * time.Millisecond
+
+	comm := &hangingCommunicator{
+		recordingCommunicator: testCommandCommunicator(nil),
+		release:               make(chan struct{}),
+	}
+	defer close(comm.release)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Provision(testUI(nil), comm)
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("should not wait for the hung command to exit")
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "execute timed out after") {
+		t.Fatalf("should be an error naming the execute phase, but got: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("should write log file, but got: %s", err)
+	}
+
+	if ok := strings.Contains(string(data), "-TERM -- -$pgid"); !ok {
+		t.Errorf("should record the kill command, but got: %s", data)
+	}
+}
+
+func TestProvisionerProvision_LogFilePhases(t *testing.T) {
+	var err error
+	var p Provisioner
+
+	config := testConfig()
+
+	directory := testDirectory(t, map[string]string{
+		"base.rb": "",
+		"app.rb":  "",
+	})
+	defer os.RemoveAll(directory)
+
+	logFile := filepath.Join(directory, "itamae.log")
+
+	config["source_directory"] = directory
+	config["log_file"] = logFile
+	config["phases"] = []map[string]interface{}{
+		{
+			"name":    "base",
+			"recipes": []string{"base.rb"},
+		},
+		{
+			"name":             "app",
+			"recipes":          []string{"app.rb"},
+			"environment_vars": []string{"DB_PASSWORD=hunter2"},
+		},
+	}
+
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not error, but got: %s", err)
+	}
+
+	err = p.Provision(testUI(nil), testCommandCommunicator(nil))
+	if err != nil {
+		t.Errorf("should not error, but got: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("should write log file, but got: %s", err)
+	}
+	content := string(data)
+
+	if ok := strings.Contains(content, "hunter2"); ok {
+		t.Errorf("should redact phase environment variables, but got: %s", content)
+	}
+
+	if ok := strings.Contains(content, "DB_PASSWORD='<redacted>'"); !ok {
+		t.Errorf("should include redacted phase environment variable, but got: %s", content)
+	}
+}